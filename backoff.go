@@ -0,0 +1,76 @@
+package amqprpc
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// BackoffStrategy returns the duration to wait before the given reconnect
+// attempt. The first reconnect attempt after a connection failure is attempt
+// 1 and the attempts are counted from 1 again after a successful connection.
+type BackoffStrategy func(attempt int) time.Duration
+
+// ConstantBackoff returns a BackoffStrategy which always waits d before
+// reconnecting. This is the default strategy with d set to 500 ms.
+func ConstantBackoff(d time.Duration) BackoffStrategy {
+	return func(attempt int) time.Duration {
+		return d
+	}
+}
+
+// ExponentialBackoff returns a BackoffStrategy which waits base before the
+// first attempt and then doubles the time for each attempt, but never more
+// than max.
+func ExponentialBackoff(base, max time.Duration) BackoffStrategy {
+	return func(attempt int) time.Duration {
+		d := base
+
+		for i := 1; i < attempt && d < max; i++ {
+			d *= 2
+		}
+
+		if d > max {
+			return max
+		}
+
+		return d
+	}
+}
+
+// DecorrelatedJitterBackoff returns a BackoffStrategy which waits a random
+// duration between base and three times the previous duration, but never more
+// than max. This spreads out reconnects from many clients and servers which
+// lost their connection at the same time.
+// See https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
+// for more information.
+func DecorrelatedJitterBackoff(base, max time.Duration) BackoffStrategy {
+	var (
+		mu   sync.Mutex
+		rnd  = rand.New(rand.NewSource(time.Now().UnixNano()))
+		prev = base
+	)
+
+	return func(attempt int) time.Duration {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if attempt <= 1 {
+			prev = base
+		}
+
+		d := base
+
+		if upper := prev * 3; upper > base {
+			d += time.Duration(rnd.Int63n(int64(upper - base)))
+		}
+
+		if d > max {
+			d = max
+		}
+
+		prev = d
+
+		return d
+	}
+}
@@ -0,0 +1,57 @@
+package amqprpc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConstantBackoff(t *testing.T) {
+	b := ConstantBackoff(100 * time.Millisecond)
+
+	for _, attempt := range []int{1, 2, 10} {
+		assert.Equal(t, 100*time.Millisecond, b(attempt), "same backoff for all attempts")
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	b := ExponentialBackoff(100*time.Millisecond, time.Second)
+
+	cases := []struct {
+		attempt  int
+		expected time.Duration
+	}{
+		{attempt: 1, expected: 100 * time.Millisecond},
+		{attempt: 2, expected: 200 * time.Millisecond},
+		{attempt: 3, expected: 400 * time.Millisecond},
+		{attempt: 4, expected: 800 * time.Millisecond},
+		{attempt: 5, expected: time.Second},
+		{attempt: 1000, expected: time.Second},
+	}
+
+	for _, tc := range cases {
+		assert.Equal(t, tc.expected, b(tc.attempt), "correct backoff for attempt %d", tc.attempt)
+	}
+}
+
+func TestDecorrelatedJitterBackoff(t *testing.T) {
+	var (
+		base = 100 * time.Millisecond
+		max  = 2 * time.Second
+		b    = DecorrelatedJitterBackoff(base, max)
+		prev = base
+	)
+
+	for attempt := 1; attempt < 100; attempt++ {
+		d := b(attempt)
+
+		assert.True(t, d >= base, "backoff is at least base")
+		assert.True(t, d <= max, "backoff is at most max")
+		assert.True(t, d <= prev*3, "backoff is at most three times the previous")
+
+		prev = d
+	}
+
+	assert.True(t, b(1) <= 3*base, "backoff is reset on first attempt")
+}
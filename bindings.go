@@ -14,6 +14,33 @@ type HandlerBinding struct {
 	RoutingKey   string
 	BindHeaders  amqp.Table
 	Handler      HandlerFunc
+
+	// DeadLetterExchange is the exchange to which messages nacked or
+	// rejected without requeue are dead lettered. If set, the exchange and
+	// the queue QueueName + DeadLetterQueueSuffix are declared and bound
+	// when the server starts. See WithDeadLetter.
+	DeadLetterExchange string
+
+	// MaxPriority is the maximum priority of the queue, 0 means that the
+	// queue isn't a priority queue. See WithMaxPriority.
+	MaxPriority uint8
+
+	// MaxConcurrency is the maximum number of handlers running at the same
+	// time for the binding, 0 means no limit. See WithMaxConcurrency.
+	MaxConcurrency int
+}
+
+// WithDeadLetter returns a copy of the binding with dead lettering to
+// exchange. If exchange is an empty string DefaultDeadLetterExchange is
+// used. The binding must have a queue name.
+func (b HandlerBinding) WithDeadLetter(exchange string) HandlerBinding {
+	if exchange == "" {
+		exchange = DefaultDeadLetterExchange
+	}
+
+	b.DeadLetterExchange = exchange
+
+	return b
 }
 
 // DirectBinding returns a HandlerBinding to use for direct exchanges where each
@@ -68,3 +95,37 @@ func HeadersBinding(queueName string, headers amqp.Table, handler HandlerFunc) H
 		Handler:      handler,
 	}
 }
+
+// WithMaxPriority returns a copy of the binding which declares the queue as
+// a priority queue with max as the maximum priority. RabbitMQ recommends a
+// maximum priority of 10 or less. Note that an existing queue can't be
+// changed to a priority queue, it must be deleted first.
+func (b HandlerBinding) WithMaxPriority(max uint8) HandlerBinding {
+	b.MaxPriority = max
+
+	return b
+}
+
+// maxPriorityQueueArgs returns a copy of args with the argument needed to
+// declare the queue of the binding as a priority queue.
+func maxPriorityQueueArgs(binding HandlerBinding, args amqp.Table) amqp.Table {
+	queueArgs := amqp.Table{}
+	for k, v := range args {
+		queueArgs[k] = v
+	}
+
+	queueArgs["x-max-priority"] = int32(binding.MaxPriority)
+
+	return queueArgs
+}
+
+// WithMaxConcurrency returns a copy of the binding which runs at most n
+// handlers at the same time. This is independent of the prefetch count, the
+// deliveries prefetched wait in the server until a handler is finished and are
+// requeued if the server is shut down meanwhile. Use Server.WorkerStats to see
+// how long deliveries are waiting.
+func (b HandlerBinding) WithMaxConcurrency(n int) HandlerBinding {
+	b.MaxConcurrency = n
+
+	return b
+}
@@ -53,6 +53,40 @@ func TestFanout(t *testing.T) {
 	assert.Equal(atomic.LoadInt64(&timesCalled), int64(3), "endpoint called 3 times")
 }
 
+func TestFanoutGather(t *testing.T) {
+	for i := range make([]struct{}, 3) {
+		s := NewServer(bindingsTestURL, QosConfig{})
+		s.Bind(FanoutBinding("fanout-gather-exchange", func(i int) HandlerFunc {
+			return func(ctx context.Context, rw *ResponseWriter, d amqp.Delivery) {
+				fmt.Fprintf(rw, "shard %d", i)
+			}
+		}(i)))
+
+		stop := startAndWait(s)
+		defer stop()
+	}
+
+	c := NewClient(bindingsTestURL, QosConfig{})
+
+	replies, err := c.Gather(
+		NewRequest().
+			WithExchange("fanout-gather-exchange").
+			WithMultipleReplies(3),
+	)
+
+	assert.Nil(t, err, "no errors gathering replies")
+	assert.Equal(t, 3, len(replies), "replies from all servers")
+
+	replies, err = c.Gather(
+		NewRequest().
+			WithExchange("fanout-gather-exchange").
+			WithTimeout(500 * time.Millisecond),
+	)
+
+	assert.Nil(t, err, "timeout ends gathering without error")
+	assert.Equal(t, 3, len(replies), "replies from all servers until timeout")
+}
+
 func TestTopic(t *testing.T) {
 	wasCalled := map[string]chan string{
 		"foo.#": make(chan string),
@@ -0,0 +1,64 @@
+package amqprpc
+
+import (
+	"github.com/streadway/amqp"
+)
+
+// Call represents an active request sent with Client.Go. When the request is
+// finished the call will be sent on Done with either the Delivery or the Error
+// set.
+type Call struct {
+	// Request is the request that was sent.
+	Request *Request
+
+	// Delivery is the response received, this will be nil for requests not
+	// waiting for a reply.
+	Delivery *amqp.Delivery
+
+	// Error is the error returned from Send, if any.
+	Error error
+
+	// Done will receive the call itself when the request is finished.
+	Done chan *Call
+}
+
+/*
+Go will send the Request asynchronously. It returns a Call representing the
+request which will be sent on done when the request is finished. If done is
+nil a new channel will be allocated. The request is sent with Send which means
+that all middlewares are executed just as when calling Send directly.
+
+Just like net/rpc, done must be buffered or Go will panic. If done doesn't have
+enough room for all the calls using it, the calls will block until there's
+room.
+
+	done := make(chan *Call, len(requests))
+
+	for _, r := range requests {
+		c.Go(r, done)
+	}
+
+	for range requests {
+		call := <-done
+		// Handle call.Delivery or call.Error
+	}
+*/
+func (c *Client) Go(r *Request, done chan *Call) *Call {
+	if done == nil {
+		done = make(chan *Call, 10)
+	} else if cap(done) == 0 {
+		panic("amqprpc: done channel is unbuffered")
+	}
+
+	call := &Call{
+		Request: r,
+		Done:    done,
+	}
+
+	go func() {
+		call.Delivery, call.Error = c.Send(r)
+		call.Done <- call
+	}()
+
+	return call
+}
@@ -0,0 +1,54 @@
+package amqprpc
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientGo(t *testing.T) {
+	c := NewClient("", QosConfig{})
+	c.Sender = func(r *Request) (*amqp.Delivery, error) {
+		if r.RoutingKey == "fail" {
+			return nil, errors.New("failed")
+		}
+
+		return &amqp.Delivery{Body: r.Publishing.Body}, nil
+	}
+
+	c.AddMiddleware(func(next SendFunc) SendFunc {
+		return func(r *Request) (*amqp.Delivery, error) {
+			fmt.Fprint(r, " with middleware")
+
+			return next(r)
+		}
+	})
+
+	done := make(chan *Call, 2)
+	okCall := c.Go(NewRequest().WithBody("hello"), done)
+	failCall := c.Go(NewRequest().WithRoutingKey("fail"), done)
+
+	calls := map[*Call]bool{}
+	for i := 0; i < 2; i++ {
+		calls[<-done] = true
+	}
+
+	assert.True(t, calls[okCall], "successful call done")
+	assert.True(t, calls[failCall], "failed call done")
+
+	assert.Nil(t, okCall.Error, "no error from successful call")
+	assert.Equal(t, []byte("hello with middleware"), okCall.Delivery.Body, "middlewares executed")
+
+	assert.NotNil(t, failCall.Error, "error from failing call")
+	assert.Nil(t, failCall.Delivery, "no delivery from failing call")
+
+	call := c.Go(NewRequest(), nil)
+	assert.Equal(t, call, <-call.Done, "done allocated when nil")
+
+	assert.Panics(t, func() {
+		c.Go(NewRequest(), make(chan *Call))
+	}, "unbuffered done chan panics")
+}
@@ -1,7 +1,9 @@
 package amqprpc
 
 import (
+	"context"
 	"log"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -10,6 +12,40 @@ import (
 	"github.com/streadway/amqp"
 )
 
+// shutdownPollInterval is how often Shutdown checks if all requests are
+// finished.
+const shutdownPollInterval = 10 * time.Millisecond
+
+// OnConnectedFunc is the function that can be passed to Client.OnConnected().
+type OnConnectedFunc func(*amqp.Connection, *amqp.Connection, *amqp.Channel, *amqp.Channel)
+
+// OnDisconnectedFunc is the function that can be passed to
+// Client.OnDisconnected(). The error is nil if the client was stopped.
+type OnDisconnectedFunc func(error)
+
+// OnReconnectingFunc is the function that can be passed to
+// Client.OnReconnecting().
+type OnReconnectingFunc func(attempt int)
+
+// OnUnmatchedReplyFunc is the function that can be passed to
+// Client.OnUnmatchedReply().
+type OnUnmatchedReplyFunc func(amqp.Delivery)
+
+// ReplyStats holds counters for the replies received by a client.
+type ReplyStats struct {
+	// Matched is the number of replies forwarded to a waiting request.
+	Matched uint64
+
+	// Unmatched is the number of replies where no request was waiting, i.e.
+	// replies arriving after the request timed out.
+	Unmatched uint64
+
+	// Abandoned is the number of replies to a request which stopped waiting
+	// while the reply was forwarded, i.e. when more servers than expected
+	// replies to a fanout request.
+	Abandoned uint64
+}
+
 // Client represents an AMQP client used within a RPC framework.
 // This client can be used to communicate with RPC servers.
 type Client struct {
@@ -20,21 +56,22 @@ type Client struct {
 	// we assume the request got lost.
 	timeout time.Duration
 
-	// requests is a single channel used whenever we want to publish
-	// a message. The channel is consumed in a separate go routine which
-	// allows us to add messages to the channel that we don't want replys from
-	// without the need to wait for on going requests.
-	requests chan *Request
-
-	// correlationMapping maps each correlation ID to a channel of
-	// *amqp.Delivery. This is to ensure that no matter the order of a request
-	// and response, we will always publish the response to the correct
-	// consumer. Since we create the correlation ID and hang waiting for the
-	// delivery channel this is an easy way to ensure no overlapping. This can
-	// of course be a problem if the correlation IDs used is not unique enough
-	// in which case a queueChannel might be overridden if it hasn't been
-	// cleared before.
-	correlationMapping map[string]chan *amqp.Delivery
+	// requests is a single queue used whenever we want to publish a
+	// message. The queue is consumed in a separate go routine which allows us
+	// to add messages to the queue that we don't want replys from without the
+	// need to wait for on going requests. Requests with a higher priority are
+	// published first.
+	requests *requestQueue
+
+	// correlationMapping maps each correlation ID to the request waiting for
+	// it. This is to ensure that no matter the order of a request and
+	// response, we will always publish the response (or a returned
+	// publishing) to the correct consumer. Since we create the correlation ID
+	// and hang waiting for the delivery channel this is an easy way to ensure
+	// no overlapping. This can of course be a problem if the correlation IDs
+	// used is not unique enough in which case a request might be overridden
+	// if it hasn't been cleared before.
+	correlationMapping map[string]*pendingRequest
 
 	// mu is used to protect the correlationMapping for concurrent access.
 	mu sync.RWMutex
@@ -46,6 +83,10 @@ type Client struct {
 	// connection/dialer.go.
 	dialconfig amqp.Config
 
+	// connectionManager is used to get the connections from if set instead
+	// of creating new connections for the client.
+	connectionManager *ConnectionManager
+
 	// queueDeclareSettings is configuration used when declaring a RabbitMQ
 	// queue.
 	queueDeclareSettings QueueDeclareSettings
@@ -58,21 +99,73 @@ type Client struct {
 	// the client
 	publishSettings PublishSettings
 
+	// confirmMode will put the output channel in confirm mode. Requests
+	// without a reply will not be considered sent until the broker has acked
+	// the publishing.
+	confirmMode bool
+
 	// replyToQueueName can be used to avoid generating queue names on the message
 	// bus and use a pre defined name throughout the usage of a client.
 	replyToQueueName string
 
+	// directReplyTo will make the client use RabbitMQ direct reply-to
+	// instead of declaring a reply-to queue.
+	directReplyTo bool
+
+	// delayedMessageExchange is the x-delayed-message exchange used for
+	// delayed requests, if empty delay queues are used.
+	delayedMessageExchange string
+
 	// middlewares holds slice of middlewares to run before or after the client
 	// sends a request.
 	middlewares []ClientMiddlewareFunc
 
+	// onConnecteds will all be executed each time the client has connected.
+	onConnecteds []OnConnectedFunc
+
+	// onDisconnecteds will all be executed each time the client has lost the
+	// connection or has been stopped.
+	onDisconnecteds []OnDisconnectedFunc
+
+	// onReconnectings will all be executed before each reconnect attempt.
+	onReconnectings []OnReconnectingFunc
+
+	// onUnmatchedReplies will all be executed for each reply which couldn't
+	// be forwarded to a waiting request.
+	onUnmatchedReplies []OnUnmatchedReplyFunc
+
+	// replyStats counts the replies received, only accessed atomically.
+	replyStats ReplyStats
+
 	// stopChan channel is used to signal shutdowns when calling Stop(). The
-	// channel will be closed when Stop() is called.
+	// channel will be closed when Stop() is called, stopOnce makes sure it's
+	// only closed once each time the client is started.
 	stopChan chan struct{}
+	stopOnce *sync.Once
 
 	// isRunning is 1 when the server is running.
 	isRunning int32
 
+	// isClosed is 1 when the client is shut down and won't accept any new
+	// requests.
+	isClosed int32
+
+	// closedChan is closed when the client has been shut down and any
+	// requests still waiting are abandoned.
+	closedChan chan struct{}
+
+	// reconnectBackoff is used to decide how long to wait before each
+	// reconnect attempt.
+	reconnectBackoff BackoffStrategy
+
+	// maxReconnectAttempts is the number of reconnect attempts before the
+	// client gives up, 0 means that it will never give up.
+	maxReconnectAttempts int
+
+	// reconnectAttempt is the number of the current reconnect attempt, it's
+	// reset each time the client successfully connects.
+	reconnectAttempt int
+
 	// errorLog specifies an optional logger for amqp errors, unexpected
 	// behavior etc. If nil, logging is done via the log package's standard
 	// logger.
@@ -102,17 +195,19 @@ type Client struct {
 // connection to the message bus.
 func NewClient(url string, qc QosConfig) *Client {
 	c := &Client{
-		url: url,
+		url:       url,
 		qosConfig: qc,
 		dialconfig: amqp.Config{
 			Dial: DefaultDialer,
 		},
-		requests:           make(chan *Request),
-		correlationMapping: make(map[string]chan *amqp.Delivery),
+		requests:           newRequestQueue(),
+		closedChan:         make(chan struct{}),
+		correlationMapping: make(map[string]*pendingRequest),
 		mu:                 sync.RWMutex{},
 		replyToQueueName:   "reply-to-" + uuid.Must(uuid.NewV4(), nil).String(),
 		middlewares:        []ClientMiddlewareFunc{},
 		timeout:            time.Second * 10,
+		reconnectBackoff:   ConstantBackoff(500 * time.Millisecond),
 		errorLog:           log.Printf,                                  // use the standard logger default.
 		debugLog:           func(format string, args ...interface{}) {}, // don't print anything default.
 	}
@@ -132,6 +227,15 @@ func (c *Client) WithDialConfig(dc amqp.Config) *Client {
 	return c
 }
 
+// WithConnectionManager makes the client use the connections of the
+// ConnectionManager instead of creating it's own connections. The client will
+// still create it's own channels. Any dial config set on the client is ignored.
+func (c *Client) WithConnectionManager(m *ConnectionManager) *Client {
+	c.connectionManager = m
+
+	return c
+}
+
 // WithTLS sets the TLS config in the dial config for the client.
 func (c *Client) WithTLS(cert Certificates) *Client {
 	c.dialconfig.TLSClientConfig = cert.TLSConfig()
@@ -175,6 +279,109 @@ func (c *Client) WithTimeout(t time.Duration) *Client {
 	return c
 }
 
+// WithDirectReplyTo will make the client use RabbitMQ direct reply-to
+// (amq.rabbitmq.reply-to) for replies instead of declaring a reply-to queue.
+// This avoids creating a queue for each client but the replies will be lost
+// if the client reconnects while waiting for them.
+// See https://www.rabbitmq.com/direct-reply-to.html for more information.
+func (c *Client) WithDirectReplyTo(directReplyTo bool) *Client {
+	c.directReplyTo = directReplyTo
+
+	return c
+}
+
+// WithReconnectBackoff sets the BackoffStrategy used to decide how long to
+// wait before each reconnect attempt. If maxAttempts is larger than zero the
+// client will give up after that many failed attempts in a row, the client
+// will then try to connect again on the next call to Send.
+func (c *Client) WithReconnectBackoff(b BackoffStrategy, maxAttempts int) *Client {
+	c.reconnectBackoff = b
+	c.maxReconnectAttempts = maxAttempts
+
+	return c
+}
+
+// WithPublishSettings will set the settings used when publishing messages
+// with the client. If Mandatory is set, requests that can't be routed to any
+// queue will fail with an *ErrNoRoute instead of timing out.
+func (c *Client) WithPublishSettings(s PublishSettings) *Client {
+	c.publishSettings = s
+
+	return c
+}
+
+// WithConfirmMode sets the confirm mode used when publishing requests. When
+// confirm mode is on, Send for requests without a reply will not return until
+// the broker has acked the publishing and ErrPublishNacked will be returned if
+// the broker nacks it.
+func (c *Client) WithConfirmMode(confirmMode bool) *Client {
+	c.confirmMode = confirmMode
+
+	return c
+}
+
+/*
+OnConnected can be used to hook into the connections/channels that the client is
+using each time it has connected. This can be useful i.e. for readiness probes.
+
+	client := NewClient(url)
+	client.OnConnected(func(inConn, outConn *amqp.Connection, inChan, outChan *amqp.Channel) {
+		// Do something with amqp connections/channels.
+	})
+*/
+func (c *Client) OnConnected(f OnConnectedFunc) *Client {
+	c.onConnecteds = append(c.onConnecteds, f)
+
+	return c
+}
+
+// OnDisconnected will add a function which is executed each time the client
+// has lost the connection, with the error causing it, or has been stopped,
+// with a nil error.
+func (c *Client) OnDisconnected(f OnDisconnectedFunc) *Client {
+	c.onDisconnecteds = append(c.onDisconnecteds, f)
+
+	return c
+}
+
+// OnReconnecting will add a function which is executed before each reconnect
+// attempt with the number of the attempt.
+func (c *Client) OnReconnecting(f OnReconnectingFunc) *Client {
+	c.onReconnectings = append(c.onReconnectings, f)
+
+	return c
+}
+
+/*
+OnUnmatchedReply will add a function which is executed for each reply that
+couldn't be forwarded to a waiting request. This happens when a reply arrives
+after the request timed out or was canceled, or when more replies than
+expected arrives for a request. This can be used to measure how often
+replies are late or to persist late results.
+
+	client := NewClient(url)
+	client.OnUnmatchedReply(func(d amqp.Delivery) {
+		lateReplies.Inc()
+	})
+
+The functions are executed by the replies consumer and must not block since
+no other replies are forwarded while they're running.
+*/
+func (c *Client) OnUnmatchedReply(f OnUnmatchedReplyFunc) *Client {
+	c.onUnmatchedReplies = append(c.onUnmatchedReplies, f)
+
+	return c
+}
+
+// ReplyStats returns the counters for the replies received by the client.
+func (c *Client) ReplyStats() ReplyStats {
+	return ReplyStats{
+		Matched:   atomic.LoadUint64(&c.replyStats.Matched),
+		Unmatched: atomic.LoadUint64(&c.replyStats.Unmatched),
+		Abandoned: atomic.LoadUint64(&c.replyStats.Abandoned),
+	}
+}
+
 // AddMiddleware will add a middleware which will be executed on request.
 func (c *Client) AddMiddleware(m ClientMiddlewareFunc) *Client {
 	c.middlewares = append(c.middlewares, m)
@@ -216,9 +423,19 @@ func (c *Client) runForever() {
 		return
 	}
 
+	if atomic.LoadInt32(&c.isClosed) == 1 {
+		// Never start again once shut down.
+		atomic.StoreInt32(&c.isRunning, 0)
+		return
+	}
+
 	c.stopChan = make(chan struct{})
+	c.stopOnce = &sync.Once{}
 
 	go func() {
+		c.reconnectAttempt = 0
+
+	reconnectLoop:
 		for {
 			c.debugLog("client: connecting...")
 
@@ -228,8 +445,32 @@ func (c *Client) runForever() {
 				break
 			}
 
-			c.errorLog("client: got error: %s, will reconnect in %v second(s)", err, 0.5)
-			time.Sleep(500 * time.Millisecond)
+			if err == ErrConnectionManagerStopped {
+				c.errorLog("client: got error: %s, giving up", err)
+				break
+			}
+
+			c.reconnectAttempt++
+
+			if c.maxReconnectAttempts > 0 && c.reconnectAttempt > c.maxReconnectAttempts {
+				c.errorLog("client: got error: %s, giving up after %d attempt(s)", err, c.maxReconnectAttempts)
+				break
+			}
+
+			backoff := c.reconnectBackoff(c.reconnectAttempt)
+
+			c.errorLog("client: got error: %s, will reconnect in %v (attempt %d)", err, backoff, c.reconnectAttempt)
+
+			select {
+			case <-c.stopChan:
+				c.debugLog("client: the stopChan was triggered in a reconnect loop, exiting")
+				break reconnectLoop
+			case <-time.After(backoff):
+			}
+
+			for _, onReconnecting := range c.onReconnectings {
+				onReconnecting(c.reconnectAttempt)
+			}
 		}
 
 		// Ensure we can start again.
@@ -245,12 +486,15 @@ func (c *Client) runForever() {
 func (c *Client) runOnce() error {
 	c.debugLog("client: starting up...")
 
-	inputConn, outputConn, err := createConnections(c.url, c.dialconfig)
+	inputConn, outputConn, connErrs, cleanup, err := openConnections(c.url, c.dialconfig, c.connectionManager, c.stopChan)
+	if err == errStoppedWhileWaiting {
+		return nil
+	}
+
 	if err != nil {
 		return err
 	}
-	defer inputConn.Close()
-	defer outputConn.Close()
+	defer cleanup()
 
 	inputCh, outputCh, err := createChannels(inputConn, outputConn, c.qosConfig)
 	if err != nil {
@@ -259,20 +503,52 @@ func (c *Client) runOnce() error {
 	defer inputCh.Close()
 	defer outputCh.Close()
 
-	err = c.runRepliesConsumer(inputCh)
+	err = c.runRepliesConsumer(inputCh, outputCh)
 	if err != nil {
 		return err
 	}
 
-	go c.runPublisher(outputCh, c.stopChan)
+	var confirms chan amqp.Confirmation
+
+	if c.confirmMode {
+		err = outputCh.Confirm(false)
+		if err != nil {
+			return err
+		}
+
+		confirms = outputCh.NotifyPublish(make(chan amqp.Confirmation, 100))
+	}
+
+	// Publishings that can't be routed will be returned when using the
+	// mandatory flag.
+	returns := outputCh.NotifyReturn(make(chan amqp.Return, 100))
+
+	go c.runPublisher(outputCh, confirms, returns, c.stopChan)
+
+	// We're connected, start counting reconnect attempts from the beginning
+	// the next time we lose the connection.
+	c.reconnectAttempt = 0
+
+	// Notify everyone that the client has connected. Runs sequentially so
+	// there isn't any race conditions when working with the connections or
+	// channels.
+	for _, onConnected := range c.onConnecteds {
+		onConnected(inputConn, outputConn, inputCh, outputCh)
+	}
 
 	err = monitorAndWait(
 		c.stopChan,
-		inputConn.NotifyClose(make(chan *amqp.Error)),
-		outputConn.NotifyClose(make(chan *amqp.Error)),
-		inputCh.NotifyClose(make(chan *amqp.Error)),
-		outputCh.NotifyClose(make(chan *amqp.Error)),
+		append(
+			connErrs,
+			inputCh.NotifyClose(make(chan *amqp.Error)),
+			outputCh.NotifyClose(make(chan *amqp.Error)),
+		)...,
 	)
+
+	for _, onDisconnected := range c.onDisconnecteds {
+		onDisconnected(err)
+	}
+
 	if err != nil {
 		return err
 	}
@@ -284,34 +560,98 @@ func (c *Client) runOnce() error {
 // amqp exchange. The method will stop consuming if the underlying amqp channel
 // is closed for any reason, and when this happens the messages will be put back
 // in chan requests unless we have retried to many times.
-func (c *Client) runPublisher(outChan *amqp.Channel, stopChan chan struct{}) {
+// If confirms is not nil the channel is in confirm mode and each publishing is
+// tracked by it's delivery tag until the broker has acked or nacked it.
+// Requests still waiting for a confirmation when the publisher stops will
+// eventually time out.
+// The confirmations and returns are handled by runConfirmer in a go routine of
+// it's own. They must always be read since the connection blocks until they
+// are, which would deadlock the publisher when it's waiting for the broker,
+// i.e. when declaring a delay queue.
+func (c *Client) runPublisher(outChan *amqp.Channel, confirms chan amqp.Confirmation, returns chan amqp.Return, stopChan chan struct{}) {
 	c.debugLog("client: running publisher...")
 
+	var (
+		// unconfirmed holds the requests waiting for a confirmation from
+		// the broker.
+		unconfirmed = newUnconfirmedRequests()
+
+		// confirmerDone is closed when the confirmer stops because the
+		// channel was closed.
+		confirmerDone = make(chan struct{})
+
+		// bound holds the exchanges and routing keys bound to the delayed
+		// message exchange on this channel.
+		bound = map[string]struct{}{}
+
+		// declared holds the delay queues declared on this channel and when.
+		declared = map[string]time.Time{}
+	)
+
+	go func() {
+		c.runConfirmer(confirms, returns, unconfirmed, stopChan)
+		close(confirmerDone)
+	}()
+
 	for {
 		select {
 		case <-stopChan:
 			c.debugLog("client: publisher stopped after stop chan was closed")
 			return
 
-		case request := <-c.requests:
+		case <-confirmerDone:
+			c.debugLog("client: publisher stopped after the channel was closed")
+			return
+
+		case <-c.requests.ready:
+			request, ok := c.requests.pop()
+			if !ok {
+				continue
+			}
+
+			if c.abandoned(request) {
+				// The sender has already given up on this request, there's
+				// no reason to publish it.
+				c.debugLog("client: dropping abandoned request %s", request.publishing.CorrelationId)
+				continue
+			}
+
 			replyToQueueName := ""
 
-			if request.Reply {
+			if request.request.Reply {
 				// We only need the replyTo queue if we actually want a reply.
 				replyToQueueName = c.replyToQueueName
+
+				if c.directReplyTo {
+					replyToQueueName = DirectReplyToQueue
+				}
 			}
 
-			c.debugLog("client: publishing %s", request.Publishing.CorrelationId)
+			c.debugLog("client: publishing %s", request.publishing.CorrelationId)
 
-			request.Publishing.ReplyTo = replyToQueueName
+			request.publishing.ReplyTo = replyToQueueName
 
-			err := outChan.Publish(
-				request.Exchange,
-				request.RoutingKey,
-				c.publishSettings.Mandatory,
-				c.publishSettings.Immediate,
-				request.Publishing,
-			)
+			exchange, routingKey, publishing, err := c.destination(outChan, request, bound, declared)
+			if err == nil {
+				// The request is tracked before it's published since the
+				// confirmation might be handled before Publish returns.
+				var deliveryTag uint64
+				if confirms != nil {
+					deliveryTag = unconfirmed.add(request)
+				}
+
+				err = outChan.Publish(
+					exchange,
+					routingKey,
+					c.publishSettings.Mandatory,
+					c.publishSettings.Immediate,
+					publishing,
+				)
+
+				if err != nil && confirms != nil {
+					unconfirmed.remove(deliveryTag)
+				}
+			}
 
 			if err != nil {
 				// Close the outChan to ensure reconnect.
@@ -323,61 +663,203 @@ func (c *Client) runPublisher(outChan *amqp.Channel, stopChan chan struct{}) {
 					// will get an error back and should handle this manually!
 					c.errorLog(
 						"client: could not publish %s, giving up: %s",
-						request.Publishing.CorrelationId, err.Error(),
+						request.publishing.CorrelationId, err.Error(),
 					)
 					request.errChan <- err
 				} else {
 					c.errorLog(
 						"client: could not publish %s, retrying: %s",
-						request.Publishing.CorrelationId, err.Error(),
+						request.publishing.CorrelationId, err.Error(),
 					)
 
 					request.numRetries++
-					c.requests <- request
+					c.requests.push(request)
 				}
 
-				c.errorLog("client: publisher stopped because of error, %s", request.Publishing.CorrelationId)
+				c.errorLog("client: publisher stopped because of error, %s", request.publishing.CorrelationId)
 				return
 			}
 
-			if !request.Reply {
+			c.debugLog("client: did publish %s", request.publishing.CorrelationId)
+
+			if confirms != nil {
+				// The request is finished when the broker has confirmed it.
+				continue
+			}
+
+			if !request.request.Reply {
 				// We don't expect a response, so just respond directly here
 				// with nil to let send() return.
 				request.response <- nil
 			}
+		}
+	}
+}
 
-			c.debugLog("client: did publish %s", request.Publishing.CorrelationId)
+// abandoned tells if the sender of p has stopped waiting for it.
+func (c *Client) abandoned(p *pendingRequest) bool {
+	if p.request.Context.Err() != nil {
+		return true
+	}
+
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// unconfirmedRequests holds the requests published in confirm mode waiting
+// for a confirmation from the broker, by delivery tag.
+type unconfirmedRequests struct {
+	mu sync.Mutex
+
+	// deliveryTag is the delivery tag of the latest publishing, the broker
+	// starts counting from 1 on each new channel.
+	deliveryTag uint64
+	requests    map[uint64]*pendingRequest
+}
+
+func newUnconfirmedRequests() *unconfirmedRequests {
+	return &unconfirmedRequests{
+		requests: map[uint64]*pendingRequest{},
+	}
+}
+
+// add will add the request about to be published and return it's delivery
+// tag.
+func (u *unconfirmedRequests) add(request *pendingRequest) uint64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.deliveryTag++
+	u.requests[u.deliveryTag] = request
+
+	return u.deliveryTag
+}
+
+// remove will remove and return the request with the delivery tag.
+func (u *unconfirmedRequests) remove(deliveryTag uint64) (*pendingRequest, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	request, ok := u.requests[deliveryTag]
+	delete(u.requests, deliveryTag)
+
+	return request, ok
+}
+
+// removeRequest will remove the request no matter it's delivery tag.
+func (u *unconfirmedRequests) removeRequest(request *pendingRequest) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for deliveryTag, r := range u.requests {
+		if r == request {
+			delete(u.requests, deliveryTag)
 		}
 	}
 }
 
-// runRepliesConsumer will declare and start consuming from the queue where we
-// expect replies to come back. The method will stop consuming if the
-// underlying amqp channel is closed for any reason.
-func (c *Client) runRepliesConsumer(inChan *amqp.Channel) error {
-	queue, err := inChan.QueueDeclare(
-		c.replyToQueueName,
-		c.queueDeclareSettings.Durable,
-		c.queueDeclareSettings.DeleteWhenUnused,
-		c.queueDeclareSettings.Exclusive,
-		c.queueDeclareSettings.NoWait,
-		c.queueDeclareSettings.Args,
-	)
+// runConfirmer handles the confirmations and returns for the publisher until
+// the channel is closed or until stopChan is closed. Publishings returned
+// from the broker on returns will fail the request with an *ErrNoRoute. Since
+// the broker always sends the return before the confirmation, requests
+// without a reply can only be told that they weren't routed when using
+// confirm mode.
+func (c *Client) runConfirmer(confirms chan amqp.Confirmation, returns chan amqp.Return, unconfirmed *unconfirmedRequests, stopChan chan struct{}) {
+	for {
+		select {
+		case <-stopChan:
+			return
 
-	if err != nil {
-		return err
+		case returned, ok := <-returns:
+			if !ok {
+				c.debugLog("client: confirmer stopped after returns chan was closed")
+				return
+			}
+
+			c.handleReturn(returned, unconfirmed)
+
+		case confirmation, ok := <-confirms:
+			if !ok {
+				c.debugLog("client: confirmer stopped after confirms chan was closed")
+				return
+			}
+
+			// A return for this publishing is already buffered if there is
+			// one, handle it before the confirmation.
+			c.drainReturns(returns, unconfirmed)
+
+			request, ok := unconfirmed.remove(confirmation.DeliveryTag)
+			if !ok {
+				continue
+			}
+
+			if !confirmation.Ack {
+				c.errorLog("client: publishing %s was nacked", request.publishing.CorrelationId)
+				request.errChan <- ErrPublishNacked
+
+				continue
+			}
+
+			c.debugLog("client: publishing %s was confirmed", request.publishing.CorrelationId)
+
+			if !request.request.Reply {
+				request.response <- nil
+			}
+		}
 	}
+}
 
-	messages, err := inChan.Consume(
-		queue.Name,
-		c.consumeSettings.Consumer,
-		c.consumeSettings.AutoAck,
-		c.consumeSettings.Exclusive,
-		c.consumeSettings.NoLocal,
-		c.consumeSettings.NoWait,
-		c.consumeSettings.Args,
-	)
+// handleReturn will fail the request waiting for the returned publishing with
+// an *ErrNoRoute. The request is removed from unconfirmed so that a later
+// confirmation won't be treated as a success.
+func (c *Client) handleReturn(returned amqp.Return, unconfirmed *unconfirmedRequests) {
+	c.mu.RLock()
+	request, ok := c.correlationMapping[returned.CorrelationId]
+	c.mu.RUnlock()
+
+	if !ok {
+		c.errorLog("client: could not find request for returned publishing. CorrelationId: %s", returned.CorrelationId)
+		return
+	}
+
+	unconfirmed.removeRequest(request)
+
+	c.debugLog("client: publishing %s was returned: %s", returned.CorrelationId, returned.ReplyText)
+
+	request.errChan <- &ErrNoRoute{
+		ReplyCode:  returned.ReplyCode,
+		ReplyText:  returned.ReplyText,
+		Exchange:   returned.Exchange,
+		RoutingKey: returned.RoutingKey,
+	}
+}
+
+// drainReturns will handle all returns that are already buffered on returns
+// without blocking.
+func (c *Client) drainReturns(returns chan amqp.Return, unconfirmed *unconfirmedRequests) {
+	for {
+		select {
+		case returned, ok := <-returns:
+			if !ok {
+				return
+			}
 
+			c.handleReturn(returned, unconfirmed)
+		default:
+			return
+		}
+	}
+}
+
+// runRepliesConsumer will declare and start consuming from the queue where we
+// expect replies to come back. The method will stop consuming if the
+// underlying amqp channel is closed for any reason.
+func (c *Client) runRepliesConsumer(inChan, outChan *amqp.Channel) error {
+	messages, err := c.consumeReplies(inChan, outChan)
 	if err != nil {
 		return err
 	}
@@ -387,18 +869,34 @@ func (c *Client) runRepliesConsumer(inChan *amqp.Channel) error {
 
 		for response := range messages {
 			c.mu.RLock()
-			replyChan, ok := c.correlationMapping[response.CorrelationId]
+			request, ok := c.correlationMapping[response.CorrelationId]
 			c.mu.RUnlock()
 
 			if !ok {
 				c.errorLog("client: could not find where to reply. CorrelationId: %s", response.CorrelationId)
+
+				atomic.AddUint64(&c.replyStats.Unmatched, 1)
+				c.unmatchedReply(response)
+
 				continue
 			}
 
 			c.debugLog("client: forwarding reply %s", response.CorrelationId)
 
 			responseCopy := response
-			replyChan <- &responseCopy
+
+			select {
+			case request.response <- &responseCopy:
+				atomic.AddUint64(&c.replyStats.Matched, 1)
+			case <-request.done:
+				// The request stopped waiting for replies while we were
+				// forwarding, i.e. when multiple servers replies to a fanout
+				// request.
+				c.errorLog("client: request is no longer waiting for replies. CorrelationId: %s", response.CorrelationId)
+
+				atomic.AddUint64(&c.replyStats.Abandoned, 1)
+				c.unmatchedReply(response)
+			}
 		}
 
 		c.debugLog("client: replies consumer is done")
@@ -407,42 +905,122 @@ func (c *Client) runRepliesConsumer(inChan *amqp.Channel) error {
 	return nil
 }
 
+// unmatchedReply will execute all the OnUnmatchedReply functions for d.
+func (c *Client) unmatchedReply(d amqp.Delivery) {
+	for _, onUnmatchedReply := range c.onUnmatchedReplies {
+		onUnmatchedReply(d)
+	}
+}
+
+// consumeReplies will start consuming replies. When using direct reply-to no
+// queue is declared, instead the pseudo queue is consumed in no-ack mode on
+// the same channel as the requests are published on, as required by RabbitMQ.
+func (c *Client) consumeReplies(inChan, outChan *amqp.Channel) (<-chan amqp.Delivery, error) {
+	if c.directReplyTo {
+		return outChan.Consume(
+			DirectReplyToQueue,
+			c.consumeSettings.Consumer,
+			true,  // auto ack
+			false, // exclusive
+			false, // no local
+			false, // no wait
+			nil,   // args
+		)
+	}
+
+	queue, err := inChan.QueueDeclare(
+		c.replyToQueueName,
+		c.queueDeclareSettings.Durable,
+		c.queueDeclareSettings.DeleteWhenUnused,
+		c.queueDeclareSettings.Exclusive,
+		c.queueDeclareSettings.NoWait,
+		c.queueDeclareSettings.Args,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return inChan.Consume(
+		queue.Name,
+		c.consumeSettings.Consumer,
+		c.consumeSettings.AutoAck,
+		c.consumeSettings.Exclusive,
+		c.consumeSettings.NoLocal,
+		c.consumeSettings.NoWait,
+		c.consumeSettings.Args,
+	)
+}
+
 // Send will send a Request by using a amqp.Publishing.
 func (c *Client) Send(r *Request) (*amqp.Delivery, error) {
+	if err := r.encodePayload(); err != nil {
+		return nil, err
+	}
+
 	middlewares := append(c.middlewares, r.middlewares...)
 
 	return ClientMiddlewareChain(c.Sender, middlewares...)(r)
 }
 
+// SendContext will send a Request just like Send but with ctx set as the
+// request context. If ctx is canceled or reaches its deadline before a reply
+// is received the request is abandoned and ctx.Err() is returned. A request
+// which hasn't been published yet will never be published.
+func (c *Client) SendContext(ctx context.Context, r *Request) (*amqp.Delivery, error) {
+	return c.Send(r.WithContext(ctx))
+}
+
 func (c *Client) send(r *Request) (*amqp.Delivery, error) {
+	if atomic.LoadInt32(&c.isClosed) == 1 {
+		return nil, ErrClientClosed
+	}
+
 	// Ensure that the publisher is running.
 	c.runForever()
 
-	// This is where we get the responses back.
-	// If this request doesn't want a reply back (by setting Reply to false)
-	// this channel will get a nil message after publisher has Published the
-	// message.
-	r.response = make(chan *amqp.Delivery)
+	// Requests not created with NewRequest might not have a context.
+	if r.Context == nil {
+		r.Context = context.Background()
+	}
 
 	// Set the correlation id on the publishing if not yet set.
 	if r.Publishing.CorrelationId == "" {
 		r.Publishing.CorrelationId = uuid.Must(uuid.NewV4(), nil).String()
 	}
 
-	// This is where we get any (client) errors if they occure before we could
-	// even send the request.
-	r.errChan = make(chan error)
+	// This is where we get the responses back.
+	// If this request doesn't want a reply back (by setting Reply to false)
+	// the response channel will get a nil message after publisher has
+	// Published the message. Any (client) errors occurring before we could
+	// even send the request will end up on the error channel.
+	p := newPendingRequest(r)
 
 	// Ensure the responseConsumer will know which chan to forward the response
 	// to when the response arrives.
+	// Check if we're closed while holding the lock so a request is never
+	// added after Shutdown has started waiting for the mapping to be empty.
 	c.mu.Lock()
-	c.correlationMapping[r.Publishing.CorrelationId] = r.response
+	if atomic.LoadInt32(&c.isClosed) == 1 {
+		c.mu.Unlock()
+		close(p.done)
+
+		return nil, ErrClientClosed
+	}
+
+	c.correlationMapping[r.Publishing.CorrelationId] = p
 	c.mu.Unlock()
 
 	defer func() {
 		c.mu.Lock()
 		delete(c.correlationMapping, r.Publishing.CorrelationId)
 		c.mu.Unlock()
+
+		close(p.done)
+
+		// Don't keep the request queued if we stopped waiting before it was
+		// published.
+		c.requests.remove(p)
 	}()
 
 	// If a request timeout is specified, use that one, otherwise use the
@@ -452,33 +1030,286 @@ func (c *Client) send(r *Request) (*amqp.Delivery, error) {
 	}
 
 	// start the timeout counting now.
-	timeoutChan := r.startTimeout()
+	timeoutChan := r.startTimeout(c.maxDeliveryDelay(p))
+
+	// The publisher never reads the publishing of the request since it
+	// might be changed, i.e. when the request is sent again.
+	p.snapshotPublishing()
 
 	c.debugLog("client: queuing request %s", r.Publishing.CorrelationId)
-	c.requests <- r
+
+	// If we stop waiting before the request is published, i.e. because of a
+	// timeout, the publisher will drop it.
+	c.requests.push(p)
+
 	c.debugLog("client: waiting for reply of %s", r.Publishing.CorrelationId)
 
+	if r.stream != nil {
+		return c.waitForStream(p, timeoutChan)
+	}
+
+	if r.multipleReplies {
+		return c.waitForReplies(p, timeoutChan)
+	}
+
 	// All responses are published on the requests response channel. Hang here
 	// until a response is received and close the channel when it's read.
 	select {
-	case err := <-r.errChan:
+	case err := <-p.errChan:
 		c.debugLog("client: error for %s, %s", r.Publishing.CorrelationId, err.Error())
 		return nil, err
 	case <-timeoutChan:
 		c.debugLog("client: timeout for %s", r.Publishing.CorrelationId)
 		return nil, ErrTimeout
-	case delivery := <-r.response:
+	case <-r.Context.Done():
+		c.debugLog("client: context done for %s", r.Publishing.CorrelationId)
+		return nil, r.Context.Err()
+	case <-c.closedChan:
+		c.debugLog("client: shut down while waiting for %s", r.Publishing.CorrelationId)
+		return nil, ErrClientClosed
+	case delivery := <-p.response:
 		c.debugLog("client: got delivery for %s", r.Publishing.CorrelationId)
+
+		if remoteErr := ParseRemoteError(delivery); remoteErr != nil {
+			return nil, remoteErr
+		}
+
 		return delivery, nil
 	}
 }
 
+// waitForReplies will collect all replies for r until the expected number of
+// replies is received, the ReplyStopFunc returns true or the request times
+// out. The replies are stored on the request and the last one is returned.
+// Timing out is only considered an error if no replies were received or if
+// the request was waiting for a specific number of replies or a stop func.
+func (c *Client) waitForReplies(p *pendingRequest, timeoutChan <-chan time.Time) (*amqp.Delivery, error) {
+	var (
+		r    = p.request
+		last *amqp.Delivery
+	)
+
+	r.replies = []*amqp.Delivery{}
+
+	for {
+		select {
+		case err := <-p.errChan:
+			c.debugLog("client: error for %s, %s", r.Publishing.CorrelationId, err.Error())
+			return nil, err
+		case <-timeoutChan:
+			c.debugLog("client: timeout for %s after %d replies", r.Publishing.CorrelationId, len(r.replies))
+
+			if len(r.replies) == 0 || r.expectedReplies > 0 || r.replyStopFunc != nil {
+				return last, ErrTimeout
+			}
+
+			return last, nil
+		case <-r.Context.Done():
+			c.debugLog("client: context done for %s", r.Publishing.CorrelationId)
+			return last, r.Context.Err()
+		case <-c.closedChan:
+			c.debugLog("client: shut down while waiting for %s", r.Publishing.CorrelationId)
+			return last, ErrClientClosed
+		case delivery := <-p.response:
+			c.debugLog("client: got delivery %d for %s", len(r.replies)+1, r.Publishing.CorrelationId)
+
+			last = delivery
+			r.replies = append(r.replies, delivery)
+
+			if r.expectedReplies > 0 && len(r.replies) >= r.expectedReplies {
+				return last, nil
+			}
+
+			if r.replyStopFunc != nil && r.replyStopFunc(r.replies) {
+				return last, nil
+			}
+		}
+	}
+}
+
+// waitForStream will forward all partial replies for r to the requests stream
+// until a reply marking the end of the stream is received. Replies are
+// buffered so that a slow reader of the stream doesn't block the replies
+// consumer. The timeout is restarted each time a reply is received so it
+// applies to the time between replies and not to the whole stream.
+func (c *Client) waitForStream(p *pendingRequest, timeoutChan <-chan time.Time) (*amqp.Delivery, error) {
+	var (
+		r         = p.request
+		responses = p.response
+		pending   = []*amqp.Delivery{}
+		last      *amqp.Delivery
+	)
+
+	for {
+		var (
+			out  chan *amqp.Delivery
+			next *amqp.Delivery
+		)
+
+		if len(pending) > 0 {
+			out = r.stream
+			next = pending[0]
+		} else if responses == nil {
+			// All replies are received and forwarded.
+			return last, nil
+		}
+
+		select {
+		case out <- next:
+			pending = pending[1:]
+		case err := <-p.errChan:
+			c.debugLog("client: error for %s, %s", r.Publishing.CorrelationId, err.Error())
+			return nil, err
+		case <-timeoutChan:
+			c.debugLog("client: timeout for %s after %d replies", r.Publishing.CorrelationId, r.sequence)
+			return nil, ErrTimeout
+		case <-r.Context.Done():
+			c.debugLog("client: context done for %s", r.Publishing.CorrelationId)
+			return nil, r.Context.Err()
+		case <-c.closedChan:
+			c.debugLog("client: shut down while waiting for %s", r.Publishing.CorrelationId)
+			return nil, ErrClientClosed
+		case <-r.streamClosed:
+			c.debugLog("client: stream closed for %s", r.Publishing.CorrelationId)
+			return nil, ErrStreamClosed
+		case delivery := <-responses:
+			c.debugLog("client: got stream delivery %d for %s", r.sequence, r.Publishing.CorrelationId)
+
+			if remoteErr := ParseRemoteError(delivery); remoteErr != nil {
+				return nil, remoteErr
+			}
+
+			r.sequence++
+			last = delivery
+			pending = append(pending, delivery)
+			timeoutChan = time.After(r.Timeout)
+
+			if isStreamEnd(delivery) {
+				// Stop receiving and stop the timeout, we're only waiting for
+				// the reader to consume the pending replies now.
+				responses = nil
+				timeoutChan = nil
+			}
+		}
+	}
+}
+
+// isStreamEnd returns true if the delivery is the last reply of a stream. A
+// reply without a StreamSequenceHeader is a handler that didn't stream it's
+// response and is therefore the one and only reply.
+func isStreamEnd(d *amqp.Delivery) bool {
+	if _, ok := d.Headers[StreamSequenceHeader]; !ok {
+		return true
+	}
+
+	end, _ := d.Headers[StreamEndHeader].(bool)
+
+	return end
+}
+
+// Gather will send the request and collect every reply with the same
+// correlation ID, i.e. when sending a request to a fanout exchange. See
+// Request.WithMultipleReplies and Request.WithReplyStopFunc for how to stop
+// gathering replies before the request times out. The replies received are
+// returned even if an error occurred. Errors written by handlers are not
+// returned as errors since they're only a part of the replies, use
+// ParseRemoteError to check each reply.
+func (c *Client) Gather(r *Request) ([]*amqp.Delivery, error) {
+	r.Reply = true
+	r.multipleReplies = true
+
+	_, err := c.Send(r)
+
+	return r.replies, err
+}
+
 // Stop will gracefully disconnect from AMQP after draining first incoming then
 // outgoing messages. This method won't wait for server shutdown to complete,
-// you should instead wait for ListenAndServe to exit.
+// you should instead wait for ListenAndServe to exit. It's safe to call Stop
+// more than once and to call Shutdown after Stop.
 func (c *Client) Stop() {
 	if atomic.LoadInt32(&c.isRunning) != 1 {
 		return
 	}
-	close(c.stopChan)
+
+	c.stopOnce.Do(func() {
+		close(c.stopChan)
+	})
+}
+
+/*
+Shutdown will gracefully shut down the client. New requests will immediately
+return ErrClientClosed while requests already queued or waiting for replies
+are allowed to finish. When all requests are finished, or when ctx is done,
+the client is stopped and the connections are closed. A client that has been
+shut down can't be started again.
+
+If ctx is done before all requests are finished the remaining requests are
+abandoned, they will return ErrClientClosed, and Shutdown returns an
+*ErrRequestsAbandoned describing them.
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := client.Shutdown(ctx); err != nil {
+		log.Printf("could not shut down gracefully: %s", err)
+	}
+*/
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	alreadyClosed := !atomic.CompareAndSwapInt32(&c.isClosed, 0, 1)
+	c.mu.Unlock()
+
+	if alreadyClosed {
+		return ErrClientClosed
+	}
+
+	err := c.waitForRequests(ctx)
+
+	close(c.closedChan)
+	c.Stop()
+
+	return err
+}
+
+// waitForRequests will block until no requests are waiting for a reply or
+// until ctx is done, in which case an *ErrRequestsAbandoned describing the
+// requests still waiting is returned.
+func (c *Client) waitForRequests(ctx context.Context) error {
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for {
+		c.mu.RLock()
+		inFlight := len(c.correlationMapping)
+		c.mu.RUnlock()
+
+		if inFlight == 0 {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			abandoned := &ErrRequestsAbandoned{
+				Err: ctx.Err(),
+			}
+
+			c.mu.RLock()
+			for correlationID, p := range c.correlationMapping {
+				abandoned.Requests = append(abandoned.Requests, AbandonedRequest{
+					CorrelationID: correlationID,
+					Exchange:      p.request.Exchange,
+					RoutingKey:    p.request.RoutingKey,
+				})
+			}
+			c.mu.RUnlock()
+
+			sort.Slice(abandoned.Requests, func(i, j int) bool {
+				return abandoned.Requests[i].CorrelationID < abandoned.Requests[j].CorrelationID
+			})
+
+			return abandoned
+		}
+	}
 }
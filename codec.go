@@ -0,0 +1,204 @@
+package amqprpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"reflect"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	// ContentTypeJSON is the content type used by the JSON codec. This is
+	// also the content type used when encoding payloads for requests and
+	// responses without a content type with a registered codec.
+	ContentTypeJSON = "application/json"
+
+	// ContentTypeGob is the content type used by the gob codec.
+	ContentTypeGob = "application/x-gob"
+
+	// ErrorHeader is set on responses written with
+	// ResponseWriter.WriteError. The value is the error message and the body
+	// is the error envelope.
+	ErrorHeader = "X-Error"
+)
+
+// Codec is used to encode and decode bodies of a specific content type. JSON
+// and gob are registered by default, the packages codec/protobuf and
+// codec/msgpack register codecs for protobuf and msgpack when imported.
+type Codec interface {
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	codecs = map[string]Codec{
+		ContentTypeJSON: jsonCodec{},
+		ContentTypeGob:  gobCodec{},
+	}
+
+	codecsMu sync.RWMutex
+)
+
+// RegisterCodec will register a codec to use for it's content type. Any
+// codec already registered for the content type will be replaced.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	codecs[c.ContentType()] = c
+}
+
+// CodecFor returns the codec registered for the content type. Parameters
+// such as charset are ignored.
+func CodecFor(contentType string) (Codec, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("invalid content type '%s': %s", contentType, err.Error())
+	}
+
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	c, ok := codecs[mediaType]
+	if !ok {
+		return nil, fmt.Errorf("no codec registered for content type '%s'", mediaType)
+	}
+
+	return c, nil
+}
+
+// codecOrDefault returns the codec for the content type or the JSON codec if
+// there's no codec registered for it.
+func codecOrDefault(contentType string) Codec {
+	if c, err := CodecFor(contentType); err == nil {
+		return c
+	}
+
+	return jsonCodec{}
+}
+
+// Decode will decode the body of the delivery into v by using the codec
+// registered for the content type of the delivery.
+func Decode(d *amqp.Delivery, v interface{}) error {
+	c, err := CodecFor(d.ContentType)
+	if err != nil {
+		return err
+	}
+
+	return c.Unmarshal(d.Body, v)
+}
+
+/*
+TypedHandler returns a HandlerFunc which decodes the request body into the
+argument of fn and encodes the result of fn as the response. fn must be a
+function on the form
+
+	func(ctx context.Context, request T) (R, error)
+
+where T and R can be any type supported by the codec for the content type of
+the request. If the body can't be decoded a *RemoteError with
+CodeInvalidArgument is written and if fn returns an error it's written with
+ResponseWriter.WriteError. TypedHandler will panic if fn isn't a function on
+the correct form.
+
+	s.Bind(DirectBinding("add", TypedHandler(func(ctx context.Context, r AddRequest) (int, error) {
+		return r.A + r.B, nil
+	})))
+*/
+func TypedHandler(fn interface{}) HandlerFunc {
+	var (
+		fnValue   = reflect.ValueOf(fn)
+		fnType    = fnValue.Type()
+		ctxType   = reflect.TypeOf((*context.Context)(nil)).Elem()
+		errorType = reflect.TypeOf((*error)(nil)).Elem()
+	)
+
+	if fnType.Kind() != reflect.Func ||
+		fnType.NumIn() != 2 || fnType.In(0) != ctxType ||
+		fnType.NumOut() != 2 || fnType.Out(1) != errorType {
+		panic("amqprpc: TypedHandler needs a func(context.Context, T) (R, error)")
+	}
+
+	requestType := fnType.In(1)
+
+	return func(ctx context.Context, rw *ResponseWriter, d amqp.Delivery) {
+		request := reflect.New(requestType)
+
+		if err := Decode(&d, request.Interface()); err != nil {
+			rw.WriteError(NewRemoteError(CodeInvalidArgument, err.Error()))
+			return
+		}
+
+		out := fnValue.Call([]reflect.Value{reflect.ValueOf(ctx), request.Elem()})
+
+		if err, _ := out[1].Interface().(error); err != nil {
+			rw.WriteError(err)
+			return
+		}
+
+		if err := rw.Encode(out[0].Interface()); err != nil {
+			rw.WriteError(NewRemoteError(CodeInternal, err.Error()))
+		}
+	}
+}
+
+// SendAndDecode will send the request and decode the reply into v. If the
+// reply is an error written with ResponseWriter.WriteError, the *RemoteError
+// is returned instead.
+func (c *Client) SendAndDecode(r *Request, v interface{}) error {
+	d, err := c.Send(r)
+	if err != nil {
+		return err
+	}
+
+	if d == nil {
+		return nil
+	}
+
+	if remoteErr := ParseRemoteError(d); remoteErr != nil {
+		return remoteErr
+	}
+
+	return Decode(d, v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return ContentTypeJSON
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) ContentType() string {
+	return ContentTypeGob
+}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
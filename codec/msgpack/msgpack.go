@@ -0,0 +1,42 @@
+/*
+Package msgpack provides a codec for MessagePack. Importing the package will
+register the codec for ContentType.
+
+	import _ "github.com/cuiweiqiang/amqp-rpc/codec/msgpack"
+
+	r := NewRequest().
+		WithPayload(AddRequest{A: 1, B: 2}).
+		WithContentType(msgpack.ContentType)
+*/
+package msgpack
+
+import (
+	"github.com/vmihailenco/msgpack"
+
+	amqprpc "github.com/cuiweiqiang/amqp-rpc"
+)
+
+// ContentType is the content type used by the msgpack codec.
+const ContentType = "application/msgpack"
+
+func init() {
+	amqprpc.RegisterCodec(Codec{})
+}
+
+// Codec implements amqprpc.Codec for MessagePack.
+type Codec struct{}
+
+// ContentType implements the amqprpc.Codec interface.
+func (Codec) ContentType() string {
+	return ContentType
+}
+
+// Marshal implements the amqprpc.Codec interface.
+func (Codec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+// Unmarshal implements the amqprpc.Codec interface.
+func (Codec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
@@ -0,0 +1,28 @@
+package msgpack
+
+import (
+	"testing"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+
+	amqprpc "github.com/cuiweiqiang/amqp-rpc"
+)
+
+type payload struct {
+	Name  string
+	Count int
+}
+
+func TestCodec(t *testing.T) {
+	c, err := amqprpc.CodecFor(ContentType + "; charset=utf-8")
+	assert.Nil(t, err, "codec registered for msgpack")
+	assert.Equal(t, ContentType, c.ContentType(), "correct codec returned")
+
+	body, err := c.Marshal(payload{Name: "foo", Count: 2})
+	assert.Nil(t, err, "no error encoding msgpack")
+
+	decoded := payload{}
+	assert.Nil(t, amqprpc.Decode(&amqp.Delivery{ContentType: ContentType, Body: body}, &decoded), "no error decoding msgpack")
+	assert.Equal(t, payload{Name: "foo", Count: 2}, decoded, "same value after decoding msgpack")
+}
@@ -0,0 +1,60 @@
+/*
+Package protobuf provides a codec for protocol buffers. Importing the package
+will register the codec for ContentType.
+
+	import _ "github.com/cuiweiqiang/amqp-rpc/codec/protobuf"
+
+	r := NewRequest().
+		WithPayload(&pb.AddRequest{A: 1, B: 2}).
+		WithContentType(protobuf.ContentType)
+
+Only values implementing proto.Message can be encoded and decoded.
+*/
+package protobuf
+
+import (
+	"errors"
+
+	"github.com/golang/protobuf/proto"
+
+	amqprpc "github.com/cuiweiqiang/amqp-rpc"
+)
+
+// ContentType is the content type used by the protobuf codec.
+const ContentType = "application/x-protobuf"
+
+// ErrNotProtoMessage is returned by the protobuf codec when the value to
+// encode or decode is not a proto.Message.
+var ErrNotProtoMessage = errors.New("value is not a proto.Message")
+
+func init() {
+	amqprpc.RegisterCodec(Codec{})
+}
+
+// Codec implements amqprpc.Codec for protocol buffers.
+type Codec struct{}
+
+// ContentType implements the amqprpc.Codec interface.
+func (Codec) ContentType() string {
+	return ContentType
+}
+
+// Marshal implements the amqprpc.Codec interface.
+func (Codec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, ErrNotProtoMessage
+	}
+
+	return proto.Marshal(m)
+}
+
+// Unmarshal implements the amqprpc.Codec interface.
+func (Codec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return ErrNotProtoMessage
+	}
+
+	return proto.Unmarshal(data, m)
+}
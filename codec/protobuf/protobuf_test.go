@@ -0,0 +1,25 @@
+package protobuf
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/stretchr/testify/assert"
+
+	amqprpc "github.com/cuiweiqiang/amqp-rpc"
+)
+
+func TestCodec(t *testing.T) {
+	c, err := amqprpc.CodecFor(ContentType)
+	assert.Nil(t, err, "codec registered for protobuf")
+
+	body, err := c.Marshal(&wrappers.StringValue{Value: "foo"})
+	assert.Nil(t, err, "no error encoding protobuf")
+
+	decoded := wrappers.StringValue{}
+	assert.Nil(t, c.Unmarshal(body, &decoded), "no error decoding protobuf")
+	assert.Equal(t, "foo", decoded.Value, "same value after decoding protobuf")
+
+	_, err = c.Marshal(struct{ Name string }{})
+	assert.Equal(t, ErrNotProtoMessage, err, "only proto messages supported")
+}
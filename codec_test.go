@@ -0,0 +1,128 @@
+package amqprpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+type codecTestPayload struct {
+	Name  string
+	Count int
+}
+
+func TestCodecs(t *testing.T) {
+	for _, contentType := range []string{ContentTypeJSON, ContentTypeGob} {
+		c, err := CodecFor(contentType + "; charset=utf-8")
+		assert.Nil(t, err, "codec found for %s", contentType)
+		assert.Equal(t, contentType, c.ContentType(), "correct codec returned")
+
+		body, err := c.Marshal(codecTestPayload{Name: "foo", Count: 2})
+		assert.Nil(t, err, "no error encoding %s", contentType)
+
+		decoded := codecTestPayload{}
+		err = c.Unmarshal(body, &decoded)
+		assert.Nil(t, err, "no error decoding %s", contentType)
+		assert.Equal(t, codecTestPayload{Name: "foo", Count: 2}, decoded, "same value after decoding %s", contentType)
+	}
+
+	_, err := CodecFor("text/plain")
+	assert.NotNil(t, err, "no codec for text/plain")
+}
+
+func TestRequestWithPayload(t *testing.T) {
+	r := NewRequest().WithPayload(codecTestPayload{Name: "foo"})
+	assert.Nil(t, r.encodePayload(), "no error encoding payload")
+	assert.Equal(t, ContentTypeJSON, r.Publishing.ContentType, "JSON used by default")
+	assert.Equal(t, `{"Name":"foo","Count":0}`, string(r.Publishing.Body), "payload encoded")
+
+	r = NewRequest().WithPayload(codecTestPayload{Name: "foo"}).WithContentType(ContentTypeGob)
+	assert.Nil(t, r.encodePayload(), "no error encoding payload")
+	assert.Equal(t, ContentTypeGob, r.Publishing.ContentType, "content type kept")
+
+	decoded := codecTestPayload{}
+	assert.Nil(t, Decode(&amqp.Delivery{ContentType: r.Publishing.ContentType, Body: r.Publishing.Body}, &decoded))
+	assert.Equal(t, "foo", decoded.Name, "payload encoded with content type codec")
+}
+
+func TestResponseWriterEncode(t *testing.T) {
+	rw := &ResponseWriter{
+		publishing:         &amqp.Publishing{},
+		requestContentType: ContentTypeGob,
+	}
+
+	assert.Nil(t, rw.Encode(codecTestPayload{Name: "foo"}), "no error encoding")
+	assert.Equal(t, ContentTypeGob, rw.Publishing().ContentType, "request content type used")
+
+	rw = &ResponseWriter{
+		publishing:         &amqp.Publishing{},
+		requestContentType: "text/plain",
+	}
+
+	assert.Nil(t, rw.Encode(1), "no error encoding")
+	assert.Equal(t, ContentTypeJSON, rw.Publishing().ContentType, "JSON used by default")
+	assert.Equal(t, []byte("1"), rw.Publishing().Body, "value encoded")
+}
+
+func TestTypedHandler(t *testing.T) {
+	handler := TypedHandler(func(ctx context.Context, p codecTestPayload) (int, error) {
+		if p.Name == "" {
+			return 0, errors.New("missing name")
+		}
+
+		return p.Count * 2, nil
+	})
+
+	rw := &ResponseWriter{publishing: &amqp.Publishing{}}
+	handler(context.Background(), rw, amqp.Delivery{
+		ContentType: ContentTypeJSON,
+		Body:        []byte(`{"Name":"foo","Count":2}`),
+	})
+
+	assert.Equal(t, []byte("4"), rw.Publishing().Body, "result encoded")
+
+	rw = &ResponseWriter{publishing: &amqp.Publishing{}}
+	handler(context.Background(), rw, amqp.Delivery{
+		ContentType: ContentTypeJSON,
+		Body:        []byte(`{}`),
+	})
+
+	assert.Equal(t, "missing name", rw.Publishing().Headers[ErrorHeader], "error set as header")
+
+	rw = &ResponseWriter{publishing: &amqp.Publishing{}}
+	handler(context.Background(), rw, amqp.Delivery{
+		ContentType: ContentTypeJSON,
+		Body:        []byte(`not json`),
+	})
+
+	assert.Equal(t, CodeInvalidArgument, ParseRemoteError(&amqp.Delivery{
+		Headers: rw.Publishing().Headers,
+		Body:    rw.Publishing().Body,
+	}).Code, "invalid argument when body can't be decoded")
+
+	assert.Panics(t, func() {
+		TypedHandler(func(p codecTestPayload) int { return 0 })
+	}, "wrong function signature panics")
+}
+
+func TestClientSendAndDecode(t *testing.T) {
+	c := NewClient("", QosConfig{})
+	c.Sender = func(r *Request) (*amqp.Delivery, error) {
+		if r.RoutingKey == "fail" {
+			return &amqp.Delivery{Headers: amqp.Table{ErrorHeader: "failed"}}, nil
+		}
+
+		return &amqp.Delivery{ContentType: r.Publishing.ContentType, Body: r.Publishing.Body}, nil
+	}
+
+	result := codecTestPayload{}
+	err := c.SendAndDecode(NewRequest().WithPayload(codecTestPayload{Name: "echo"}), &result)
+	assert.Nil(t, err, "no error sending")
+	assert.Equal(t, "echo", result.Name, "reply decoded")
+
+	err = c.SendAndDecode(NewRequest().WithRoutingKey("fail"), &result)
+	assert.Equal(t, NewRemoteError(CodeUnknown, "failed"), err, "error header returned as remote error")
+}
@@ -2,10 +2,19 @@ package amqprpc
 
 import (
 	"errors"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/streadway/amqp"
 )
 
+const (
+	// DirectReplyToQueue is the pseudo queue used by RabbitMQ for direct
+	// reply-to.
+	DirectReplyToQueue = "amq.rabbitmq.reply-to"
+)
+
 var (
 	// ErrUnexpectedConnClosed is returned by ListenAndServe() if the server
 	// shuts down without calling Stop() and if AMQP does not give an error
@@ -15,8 +24,94 @@ var (
 	// ErrTimeout is an error returned when a client request does not
 	// receive a response within the client timeout duration.
 	ErrTimeout = errors.New("request timed out")
+
+	// ErrPublishNacked is an error returned when a client in confirm mode
+	// gets a nack from the broker for a published request.
+	ErrPublishNacked = errors.New("publishing was nacked by the broker")
+
+	// ErrClientClosed is an error returned when a request is sent with a
+	// client that has been shut down.
+	ErrClientClosed = errors.New("client is closed")
+
+	// ErrStreamClosed is the error of a stream closed with Stream.Close()
+	// before all replies were read.
+	ErrStreamClosed = errors.New("stream is closed")
 )
 
+// ErrNoRoute is an error returned when a request published with the
+// mandatory flag couldn't be routed to any queue and was returned by the
+// broker.
+type ErrNoRoute struct {
+	ReplyCode  uint16
+	ReplyText  string
+	Exchange   string
+	RoutingKey string
+}
+
+// Error implements the error interface.
+func (e *ErrNoRoute) Error() string {
+	return fmt.Sprintf(
+		"request to exchange '%s' with routing key '%s' was returned: %d %s",
+		e.Exchange, e.RoutingKey, e.ReplyCode, e.ReplyText,
+	)
+}
+
+// AbandonedRequest describes a request that was still waiting for a reply
+// when the client was shut down.
+type AbandonedRequest struct {
+	CorrelationID string
+	Exchange      string
+	RoutingKey    string
+}
+
+// ErrRequestsAbandoned is an error returned from Client.Shutdown() if the
+// context was done before all requests were finished.
+type ErrRequestsAbandoned struct {
+	Requests []AbandonedRequest
+	Err      error
+}
+
+// Error implements the error interface.
+func (e *ErrRequestsAbandoned) Error() string {
+	keys := make([]string, len(e.Requests))
+	for i, r := range e.Requests {
+		keys[i] = fmt.Sprintf("%s (exchange '%s', routing key '%s')", r.CorrelationID, r.Exchange, r.RoutingKey)
+	}
+
+	return fmt.Sprintf(
+		"%s, abandoned %d request(s): %s",
+		e.Err, len(e.Requests), strings.Join(keys, ", "),
+	)
+}
+
+// UnfinishedHandler describes a handler that was still running when the
+// server was shut down.
+type UnfinishedHandler struct {
+	QueueName     string
+	CorrelationID string
+	StartedAt     time.Time
+}
+
+// ErrHandlersUnfinished is an error returned from Server.Shutdown() if the
+// context was done before all handlers were finished.
+type ErrHandlersUnfinished struct {
+	Handlers []UnfinishedHandler
+	Err      error
+}
+
+// Error implements the error interface.
+func (e *ErrHandlersUnfinished) Error() string {
+	keys := make([]string, len(e.Handlers))
+	for i, h := range e.Handlers {
+		keys[i] = fmt.Sprintf("%s (queue '%s', running for %v)", h.CorrelationID, h.QueueName, time.Since(h.StartedAt).Round(time.Millisecond))
+	}
+
+	return fmt.Sprintf(
+		"%s, %d unfinished handler(s): %s",
+		e.Err, len(e.Handlers), strings.Join(keys, ", "),
+	)
+}
+
 // ExchangeDeclareSettings is the settings that will be used when a handler
 // is mapped to a fanout exchange and an exchange is declared.
 type ExchangeDeclareSettings struct {
@@ -82,8 +177,8 @@ func monitorAndWait(stopChan chan struct{}, amqpErrs ...chan *amqp.Error) error
 
 type QosConfig struct {
 	PrefetchCount int
-	PrefetchSize int
-	Global bool
+	PrefetchSize  int
+	Global        bool
 }
 
 func createConnections(url string, config amqp.Config) (*amqp.Connection, *amqp.Connection, error) {
@@ -105,6 +200,46 @@ func createConnections(url string, config amqp.Config) (*amqp.Connection, *amqp.
 	return conn1, conn2, nil
 }
 
+// openConnections returns the connections to consume and publish on, from the
+// connection manager if set or else dialed, together with the chans to monitor
+// for the connections being lost. Call cleanup when done with the
+// connections. errStoppedWhileWaiting is returned if stopChan is closed while
+// waiting for the connection manager.
+func openConnections(url string, config amqp.Config, manager *ConnectionManager, stopChan chan struct{}) (inputConn, outputConn *amqp.Connection, connErrs []chan *amqp.Error, cleanup func(), err error) {
+	if manager != nil {
+		// The connections are owned by the connection manager, only our
+		// channels are closed when we're done.
+		mc, err := manager.connections(stopChan)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+
+		done := make(chan struct{})
+		cleanup = func() {
+			close(done)
+		}
+
+		return mc.consumeConn, mc.publishConn, []chan *amqp.Error{mc.notifyLost(done)}, cleanup, nil
+	}
+
+	inputConn, outputConn, err = createConnections(url, config)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	connErrs = []chan *amqp.Error{
+		inputConn.NotifyClose(make(chan *amqp.Error)),
+		outputConn.NotifyClose(make(chan *amqp.Error)),
+	}
+
+	cleanup = func() {
+		inputConn.Close()
+		outputConn.Close()
+	}
+
+	return inputConn, outputConn, connErrs, cleanup, nil
+}
+
 func createChannels(inputConn, outputConn *amqp.Connection, qc QosConfig) (*amqp.Channel, *amqp.Channel, error) {
 	inputCh, err := inputConn.Channel()
 	if err != nil {
@@ -0,0 +1,294 @@
+package amqprpc
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+var (
+	// ErrConnectionManagerStopped is returned when asking a stopped
+	// ConnectionManager for connections or channels.
+	ErrConnectionManagerStopped = errors.New("connection manager is stopped")
+
+	// errStoppedWhileWaiting is returned to a client or server that was
+	// stopped while waiting for the connection manager to connect.
+	errStoppedWhileWaiting = errors.New("stopped while waiting for connections")
+)
+
+/*
+ConnectionManager owns one connection used for consuming and one connection
+used for publishing and keeps them connected. It can be shared between any
+number of clients and servers in the same process so they don't need to open
+two connections each.
+
+	cm := NewConnectionManager(url)
+	defer cm.Stop()
+
+	server := NewServer(url, QosConfig{}).WithConnectionManager(cm)
+	client := NewClient(url, QosConfig{}).WithConnectionManager(cm)
+
+The clients and servers using the connection manager will create their own
+channels on the shared connections. If the connection manager has to
+reconnect they will lose their channels and re-establish them as soon as the
+connection manager is connected again. When the connection manager is stopped
+they will stop reconnecting and give up.
+*/
+type ConnectionManager struct {
+	// url is the URL where the connection manager should dial.
+	url string
+
+	// dialconfig is a amqp.Config which holds information about the
+	// connections such as authentication, TLS configuration and a dialer.
+	dialconfig amqp.Config
+
+	// reconnectBackoff decides how long to wait before each reconnect
+	// attempt.
+	reconnectBackoff BackoffStrategy
+
+	// reconnectAttempt is the number of reconnect attempts in a row.
+	reconnectAttempt int
+
+	// mu is used to protect the connections and the connected chan.
+	mu sync.Mutex
+
+	// current holds the current connections, nil when not connected.
+	current *managedConnections
+
+	// connected is closed when the connections have been established. A new
+	// chan is created each time the connections are lost.
+	connected chan struct{}
+
+	startOnce sync.Once
+	stopOnce  sync.Once
+	stopChan  chan struct{}
+
+	errorLog LogFunc
+	debugLog LogFunc
+}
+
+// managedConnections holds the connections of a connection manager from when
+// they're established until they're lost.
+type managedConnections struct {
+	consumeConn *amqp.Connection
+	publishConn *amqp.Connection
+
+	// lost is closed when the connections are lost and err is the reason,
+	// nil if the connection manager was stopped. err is set before lost is
+	// closed.
+	lost chan struct{}
+	err  error
+}
+
+// notifyLost returns a chan receiving the error the connections were lost
+// with. It's used by clients and servers instead of NotifyClose on the
+// connections since listeners registered on a connection are never removed,
+// so they would pile up each time a client or server reconnects on the same
+// connections. The chan is closed if the connection manager is stopped. done
+// should be closed when the caller stops listening.
+func (mc *managedConnections) notifyLost(done chan struct{}) chan *amqp.Error {
+	lost := make(chan *amqp.Error, 1)
+
+	go func() {
+		select {
+		case <-mc.lost:
+			if err, ok := mc.err.(*amqp.Error); ok {
+				lost <- err
+				return
+			}
+
+			close(lost)
+		case <-done:
+		}
+	}()
+
+	return lost
+}
+
+// NewConnectionManager will return a pointer to a new ConnectionManager. The
+// connection manager won't connect until the first connection or channel is
+// requested.
+func NewConnectionManager(url string) *ConnectionManager {
+	return &ConnectionManager{
+		url: url,
+		dialconfig: amqp.Config{
+			Dial: DefaultDialer,
+		},
+		reconnectBackoff: ConstantBackoff(500 * time.Millisecond),
+		connected:        make(chan struct{}),
+		stopChan:         make(chan struct{}),
+		errorLog:         log.Printf,                                  // use the standard logger default.
+		debugLog:         func(format string, args ...interface{}) {}, // don't print anything default.
+	}
+}
+
+// WithDialConfig sets the dial config used for the connections.
+func (m *ConnectionManager) WithDialConfig(dc amqp.Config) *ConnectionManager {
+	m.dialconfig = dc
+
+	return m
+}
+
+// WithTLS sets the TLS config in the dial config for the connections.
+func (m *ConnectionManager) WithTLS(cert Certificates) *ConnectionManager {
+	m.dialconfig.TLSClientConfig = cert.TLSConfig()
+
+	return m
+}
+
+// WithErrorLogger sets the logger to use for error logging.
+func (m *ConnectionManager) WithErrorLogger(f LogFunc) *ConnectionManager {
+	m.errorLog = f
+	return m
+}
+
+// WithDebugLogger sets the logger to use for debug logging.
+func (m *ConnectionManager) WithDebugLogger(f LogFunc) *ConnectionManager {
+	m.debugLog = f
+	return m
+}
+
+// WithReconnectBackoff sets the BackoffStrategy used to decide how long to
+// wait before each reconnect attempt. The connection manager never gives up
+// reconnecting until it's stopped.
+func (m *ConnectionManager) WithReconnectBackoff(b BackoffStrategy) *ConnectionManager {
+	m.reconnectBackoff = b
+
+	return m
+}
+
+// ConsumeChannel will return a new channel on the connection used for
+// consuming. It blocks until the connection manager is connected.
+func (m *ConnectionManager) ConsumeChannel() (*amqp.Channel, error) {
+	mc, err := m.connections(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return mc.consumeConn.Channel()
+}
+
+// PublishChannel will return a new channel on the connection used for
+// publishing. It blocks until the connection manager is connected.
+func (m *ConnectionManager) PublishChannel() (*amqp.Channel, error) {
+	mc, err := m.connections(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return mc.publishConn.Channel()
+}
+
+// Stop will close the connections and stop reconnecting. Clients and servers
+// using the connection manager will lose their channels and give up
+// reconnecting. ConsumeChannel and PublishChannel will return
+// ErrConnectionManagerStopped.
+func (m *ConnectionManager) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.stopChan)
+	})
+}
+
+// connections will return the current connections and start the connection
+// manager if it's not already running. If not connected it will block until
+// connected, until the connection manager is stopped or until stopChan is
+// closed.
+func (m *ConnectionManager) connections(stopChan chan struct{}) (*managedConnections, error) {
+	m.startOnce.Do(func() {
+		go m.runForever()
+	})
+
+	for {
+		select {
+		case <-m.stopChan:
+			return nil, ErrConnectionManagerStopped
+		default:
+		}
+
+		m.mu.Lock()
+		current, connected := m.current, m.connected
+		m.mu.Unlock()
+
+		if current != nil {
+			return current, nil
+		}
+
+		select {
+		case <-connected:
+		case <-m.stopChan:
+			return nil, ErrConnectionManagerStopped
+		case <-stopChan:
+			return nil, errStoppedWhileWaiting
+		}
+	}
+}
+
+func (m *ConnectionManager) runForever() {
+	for {
+		m.debugLog("connection manager: connecting...")
+
+		err := m.runOnce()
+		if err == nil {
+			m.debugLog("connection manager: finished gracefully")
+			return
+		}
+
+		m.reconnectAttempt++
+
+		backoff := m.reconnectBackoff(m.reconnectAttempt)
+
+		m.errorLog("connection manager: got error: %s, will reconnect in %v (attempt %d)", err, backoff, m.reconnectAttempt)
+
+		select {
+		case <-m.stopChan:
+			m.debugLog("connection manager: the stopChan was triggered in a reconnect loop, exiting")
+			return
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// runOnce will connect and block until the connections are lost or the
+// connection manager is stopped.
+func (m *ConnectionManager) runOnce() error {
+	consumeConn, publishConn, err := createConnections(m.url, m.dialconfig)
+	if err != nil {
+		return err
+	}
+	defer consumeConn.Close()
+	defer publishConn.Close()
+
+	m.reconnectAttempt = 0
+
+	mc := &managedConnections{
+		consumeConn: consumeConn,
+		publishConn: publishConn,
+		lost:        make(chan struct{}),
+	}
+
+	m.mu.Lock()
+	m.current = mc
+	close(m.connected)
+	m.mu.Unlock()
+
+	// The only listeners registered on the connections, clients and servers
+	// are told through mc.notifyLost.
+	err = monitorAndWait(
+		m.stopChan,
+		consumeConn.NotifyClose(make(chan *amqp.Error, 1)),
+		publishConn.NotifyClose(make(chan *amqp.Error, 1)),
+	)
+
+	m.mu.Lock()
+	m.current = nil
+	m.connected = make(chan struct{})
+	m.mu.Unlock()
+
+	mc.err = err
+	close(mc.lost)
+
+	return err
+}
@@ -0,0 +1,261 @@
+package amqprpc
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	// DefaultDeadLetterExchange is the exchange used for dead lettering when
+	// no exchange is given to HandlerBinding.WithDeadLetter().
+	DefaultDeadLetterExchange = "amq-rpc.dlx"
+
+	// DeadLetterQueueSuffix is appended to the queue name of a binding to get
+	// the name of the queue where it's messages are dead lettered.
+	DeadLetterQueueSuffix = ".dlq"
+
+	// FailureReasonHeader holds the reason a message was dead lettered. It's
+	// the error written to the response, see ResponseWriter.WriteError, or
+	// "rejected" if no error was written.
+	FailureReasonHeader = "X-Failure-Reason"
+
+	// FailureQueueHeader holds the name of the queue the message was dead
+	// lettered from.
+	FailureQueueHeader = "X-Failure-Queue"
+
+	// FailureTimeHeader holds the time the message was dead lettered.
+	FailureTimeHeader = "X-Failure-Time"
+
+	// OriginalExchangeHeader holds the exchange the dead lettered message was
+	// originally published to.
+	OriginalExchangeHeader = "X-Original-Exchange"
+
+	// OriginalRoutingKeyHeader holds the routing key the dead lettered
+	// message was originally published with.
+	OriginalRoutingKeyHeader = "X-Original-Routing-Key"
+)
+
+var (
+	// ErrDeadLetterWithoutQueueName is returned when starting a server with a
+	// binding with dead lettering but without a queue name.
+	ErrDeadLetterWithoutQueueName = errors.New("dead lettering requires a binding with a queue name")
+
+	// errDeadLetterNotConfirmed is returned when the broker didn't confirm a
+	// dead lettered copy.
+	errDeadLetterNotConfirmed = errors.New("dead lettered message was not confirmed")
+)
+
+// DeadLetterQueueName returns the name of the queue where messages from
+// queueName are dead lettered.
+func DeadLetterQueueName(queueName string) string {
+	return queueName + DeadLetterQueueSuffix
+}
+
+// deadLetterQueueArgs returns a copy of args with the arguments needed to
+// make the broker dead letter messages for the binding. Requests expiring in
+// the queue because of their timeout are dead lettered too, see ExpiredInQueue.
+func deadLetterQueueArgs(binding HandlerBinding, args amqp.Table) amqp.Table {
+	queueArgs := amqp.Table{}
+	for k, v := range args {
+		queueArgs[k] = v
+	}
+
+	queueArgs["x-dead-letter-exchange"] = binding.DeadLetterExchange
+	queueArgs["x-dead-letter-routing-key"] = binding.QueueName
+
+	return queueArgs
+}
+
+// declareDeadLetter will declare the dead letter exchange and queue for the
+// binding and bind them together with the queue name of the binding as
+// routing key.
+func (s *Server) declareDeadLetter(inputCh *amqp.Channel, binding HandlerBinding) error {
+	if binding.QueueName == "" {
+		return ErrDeadLetterWithoutQueueName
+	}
+
+	err := inputCh.ExchangeDeclare(
+		binding.DeadLetterExchange,
+		"direct",
+		true,  // durable
+		false, // auto delete
+		false, // internal
+		false, // no wait
+		nil,   // args
+	)
+	if err != nil {
+		return err
+	}
+
+	dlq := DeadLetterQueueName(binding.QueueName)
+
+	_, err = inputCh.QueueDeclare(
+		dlq,
+		true,  // durable
+		false, // delete when unused
+		false, // exclusive
+		false, // no wait
+		nil,   // args
+	)
+	if err != nil {
+		return err
+	}
+
+	return inputCh.QueueBind(dlq, binding.QueueName, binding.DeadLetterExchange, false, nil)
+}
+
+// confirmedPublisher publishes messages on a channel in confirm mode and waits
+// for the broker to confirm each of them. Publishing is serialized so the next
+// confirmation always belongs to the last published message, dead lettering
+// should be rare enough for that not to matter.
+type confirmedPublisher struct {
+	ch       *amqp.Channel
+	confirms chan amqp.Confirmation
+	mu       sync.Mutex
+}
+
+// deadLetterPublisher returns a confirmedPublisher on a new channel on conn, the
+// connection used for publishing, if any of the bindings use dead lettering,
+// nil otherwise.
+func (s *Server) deadLetterPublisher(conn *amqp.Connection) (*confirmedPublisher, error) {
+	deadLettering := false
+	for _, binding := range s.bindings {
+		if binding.DeadLetterExchange != "" {
+			deadLettering = true
+		}
+	}
+
+	if !deadLettering {
+		return nil, nil
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	return &confirmedPublisher{
+		ch:       ch,
+		confirms: ch.NotifyPublish(make(chan amqp.Confirmation, 1)),
+	}, nil
+}
+
+// publish will publish msg and wait for the broker to confirm it.
+func (p *confirmedPublisher) publish(exchange, routingKey string, msg amqp.Publishing) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.ch.Publish(exchange, routingKey, false, false, msg); err != nil {
+		return err
+	}
+
+	// The chan is closed if the channel is closed before the confirmation
+	// arrives.
+	confirm, ok := <-p.confirms
+	if !ok || !confirm.Ack {
+		return errDeadLetterNotConfirmed
+	}
+
+	return nil
+}
+
+// deadLetterAcknowledger wraps the acknowledger of a delivery from a binding
+// with dead lettering. When the delivery is nacked or rejected without
+// requeue a copy with failure headers is published to the dead letter
+// exchange and the delivery is acked once the broker has confirmed the copy.
+// If the copy can't be published or isn't confirmed the delivery is nacked
+// and dead lettered by the broker instead, without the failure headers.
+type deadLetterAcknowledger struct {
+	ch       amqp.Acknowledger
+	delivery *amqp.Delivery
+	exchange string
+	queue    string
+
+	// reason returns the reason the delivery failed.
+	reason func() string
+
+	// publish is used to publish the dead lettered copy.
+	publish func(exchange, routingKey string, msg amqp.Publishing) error
+
+	errorLog LogFunc
+}
+
+func (a *deadLetterAcknowledger) Ack(tag uint64, multiple bool) error {
+	return a.ch.Ack(tag, multiple)
+}
+
+// Nack will dead letter the delivery unless requeue is set. The acknowledger
+// only belongs to this delivery so multiple is ignored, nacking deliveries
+// handled by other handlers would fail them too.
+func (a *deadLetterAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	if requeue || !a.deadLetter() {
+		return a.ch.Nack(tag, false, requeue)
+	}
+
+	return a.ch.Ack(tag, false)
+}
+
+func (a *deadLetterAcknowledger) Reject(tag uint64, requeue bool) error {
+	if requeue || !a.deadLetter() {
+		return a.ch.Reject(tag, requeue)
+	}
+
+	return a.ch.Ack(tag, false)
+}
+
+// deadLetter publishes a copy of the delivery to the dead letter exchange and
+// returns true if successful.
+func (a *deadLetterAcknowledger) deadLetter() bool {
+	d := a.delivery
+
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+
+	headers[FailureReasonHeader] = a.reason()
+	headers[FailureQueueHeader] = a.queue
+	headers[FailureTimeHeader] = time.Now().UTC()
+	headers[OriginalExchangeHeader] = d.Exchange
+	headers[OriginalRoutingKeyHeader] = d.RoutingKey
+
+	err := a.publish(a.exchange, a.queue, amqp.Publishing{
+		Headers:         headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    amqp.Persistent,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		UserId:          d.UserId,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	})
+	if err != nil {
+		a.errorLog("server: could not dead letter message from queue '%s': %s", a.queue, err.Error())
+		return false
+	}
+
+	return true
+}
+
+// failureReason returns the reason to use for a dead lettered message handled
+// with rw.
+func failureReason(rw *ResponseWriter) string {
+	if reason, ok := rw.publishing.Headers[ErrorHeader].(string); ok && reason != "" {
+		return reason
+	}
+
+	return "rejected"
+}
@@ -0,0 +1,266 @@
+package amqprpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithDeadLetter(t *testing.T) {
+	binding := DirectBinding("myqueue", nil).WithDeadLetter("")
+	assert.Equal(t, DefaultDeadLetterExchange, binding.DeadLetterExchange, "default dead letter exchange")
+
+	binding = DirectBinding("myqueue", nil).WithDeadLetter("my-dlx")
+	assert.Equal(t, "my-dlx", binding.DeadLetterExchange, "custom dead letter exchange")
+	assert.Equal(t, "myqueue.dlq", DeadLetterQueueName(binding.QueueName), "dead letter queue name")
+
+	base := amqp.Table{"x-max-length": 10}
+	args := deadLetterQueueArgs(binding, base)
+
+	assert.Equal(t, amqp.Table{
+		"x-max-length":              10,
+		"x-dead-letter-exchange":    "my-dlx",
+		"x-dead-letter-routing-key": "myqueue",
+	}, args, "dead letter arguments added")
+	assert.Equal(t, 1, len(base), "settings arguments not changed")
+}
+
+func TestDeadLetterAcknowledger(t *testing.T) {
+	var (
+		ma        = &mockAcknowledger{}
+		published = []amqp.Publishing{}
+		failing   = false
+		rw        = &ResponseWriter{publishing: &amqp.Publishing{}}
+	)
+
+	a := &deadLetterAcknowledger{
+		ch: ma,
+		delivery: &amqp.Delivery{
+			Exchange:      "amq.direct",
+			RoutingKey:    "myqueue",
+			CorrelationId: "id",
+			Headers:       amqp.Table{"some-header": "value"},
+			Body:          []byte("body"),
+		},
+		exchange: "my-dlx",
+		queue:    "myqueue",
+		reason: func() string {
+			return failureReason(rw)
+		},
+		publish: func(exchange, routingKey string, msg amqp.Publishing) error {
+			if failing {
+				return errors.New("could not publish")
+			}
+
+			assert.Equal(t, "my-dlx", exchange, "published to dead letter exchange")
+			assert.Equal(t, "myqueue", routingKey, "published with queue name")
+
+			published = append(published, msg)
+
+			return nil
+		},
+		errorLog: func(string, ...interface{}) {},
+	}
+
+	assert.Nil(t, a.Nack(1, false, true), "no error")
+	assert.Equal(t, 1, ma.nack, "requeued nack is passed on")
+	assert.Equal(t, 0, len(published), "requeued nack not dead lettered")
+
+	assert.Nil(t, a.Reject(1, false), "no error")
+	assert.Equal(t, 1, ma.ack, "dead lettered delivery is acked")
+	assert.Equal(t, 1, len(published), "rejected delivery dead lettered")
+	assert.Equal(t, "rejected", published[0].Headers[FailureReasonHeader], "default failure reason")
+
+	rw.WriteError(NewRemoteError(CodeInternal, "something broke"))
+
+	assert.Nil(t, a.Nack(1, false, false), "no error")
+	assert.Equal(t, 2, ma.ack, "dead lettered delivery is acked")
+	assert.Equal(t, 2, len(published), "nacked delivery dead lettered")
+
+	msg := published[1]
+	assert.Equal(t, "something broke", msg.Headers[FailureReasonHeader], "error is failure reason")
+	assert.Equal(t, "myqueue", msg.Headers[FailureQueueHeader], "failure queue")
+	assert.Equal(t, "amq.direct", msg.Headers[OriginalExchangeHeader], "original exchange")
+	assert.Equal(t, "myqueue", msg.Headers[OriginalRoutingKeyHeader], "original routing key")
+	assert.Equal(t, "value", msg.Headers["some-header"], "headers are kept")
+	assert.Equal(t, "id", msg.CorrelationId, "properties are kept")
+	assert.Equal(t, []byte("body"), msg.Body, "body is kept")
+
+	assert.Nil(t, a.Nack(1, true, false), "no error")
+	assert.Equal(t, 3, ma.ack, "dead lettered delivery is acked")
+	assert.Equal(t, 3, len(published), "multiple nack dead letters the delivery")
+	assert.Equal(t, "something broke", published[2].Headers[FailureReasonHeader], "failure reason for multiple nack")
+
+	failing = true
+
+	assert.Nil(t, a.Nack(1, false, false), "no error")
+	assert.Equal(t, 2, ma.nack, "broker dead letters when publishing fails")
+}
+
+func TestOriginalDestination(t *testing.T) {
+	cases := []struct {
+		description string
+		headers     amqp.Table
+		exchange    string
+		routingKey  string
+		ok          bool
+	}{
+		{
+			description: "headers from server",
+			headers:     amqp.Table{OriginalExchangeHeader: "amq.direct", OriginalRoutingKeyHeader: "myqueue"},
+			exchange:    "amq.direct",
+			routingKey:  "myqueue",
+			ok:          true,
+		},
+		{
+			description: "x-death from broker",
+			headers: amqp.Table{"x-death": []interface{}{
+				amqp.Table{"exchange": "amq.topic", "routing-keys": []interface{}{"my.topic"}},
+				amqp.Table{"exchange": "older", "routing-keys": []interface{}{"older"}},
+			}},
+			exchange:   "amq.topic",
+			routingKey: "my.topic",
+			ok:         true,
+		},
+		{
+			description: "unknown",
+			headers:     amqp.Table{},
+			ok:          false,
+		},
+	}
+
+	for _, tc := range cases {
+		exchange, routingKey, ok := OriginalDestination(amqp.Delivery{Headers: tc.headers})
+
+		assert.Equal(t, tc.ok, ok, tc.description)
+		assert.Equal(t, tc.exchange, exchange, tc.description)
+		assert.Equal(t, tc.routingKey, routingKey, tc.description)
+	}
+}
+
+func TestExpiredInQueue(t *testing.T) {
+	expired := amqp.Table{"x-death": []interface{}{
+		amqp.Table{"reason": "expired", "exchange": "amq.direct", "routing-keys": []interface{}{"myqueue"}},
+	}}
+
+	assert.True(t, ExpiredInQueue(amqp.Delivery{Headers: expired}), "expired by the broker")
+	assert.False(t, ExpiredInQueue(amqp.Delivery{Headers: amqp.Table{"x-death": []interface{}{
+		amqp.Table{"reason": "rejected"},
+	}}}), "rejected by the handler")
+	assert.False(t, ExpiredInQueue(amqp.Delivery{Headers: amqp.Table{}}), "never dead lettered by the broker")
+
+	expired[FailureReasonHeader] = "something broke"
+	assert.False(t, ExpiredInQueue(amqp.Delivery{Headers: expired}), "dead lettered by the server after expiring earlier")
+}
+
+func TestReplayPublishing(t *testing.T) {
+	p := replayPublishing(amqp.Delivery{
+		Headers: amqp.Table{
+			"some-header":            "value",
+			FailureReasonHeader:      "rejected",
+			FailureQueueHeader:       "myqueue",
+			FailureTimeHeader:        time.Now(),
+			OriginalExchangeHeader:   "amq.direct",
+			OriginalRoutingKeyHeader: "myqueue",
+			DeadlineHeader:           time.Now().UnixNano() / 1e6,
+			"x-death":                []interface{}{},
+		},
+		CorrelationId: "id",
+		Body:          []byte("body"),
+	})
+
+	assert.Equal(t, amqp.Table{"some-header": "value"}, p.Headers, "dead letter headers and deadline removed")
+	assert.Equal(t, "id", p.CorrelationId, "properties are kept")
+	assert.Equal(t, []byte("body"), p.Body, "body is kept")
+}
+
+func TestDeadLetterAndReplay(t *testing.T) {
+	fail := make(chan bool, 1)
+	fail <- true
+
+	s := NewServer(serverTestURL, QosConfig{})
+	s.Bind(DirectBinding("dead-letter-queue", func(ctx context.Context, rw *ResponseWriter, d amqp.Delivery) {
+		select {
+		case <-fail:
+			rw.WriteError(NewRemoteError(CodeUnavailable, "try later"))
+			d.Nack(false, false)
+		default:
+			fmt.Fprintf(rw, "Got message: %s", d.Body)
+		}
+	}).WithDeadLetter(""))
+
+	stop := startAndWait(s)
+	defer stop()
+
+	client := NewClient(serverTestURL, QosConfig{})
+	defer client.Stop()
+
+	_, err := client.Send(NewRequest().WithRoutingKey("dead-letter-queue").WithBody("first"))
+	assert.NotNil(t, err, "handler failed")
+
+	// Wait for the message to be dead lettered.
+	time.Sleep(100 * time.Millisecond)
+
+	replayer := NewReplayer(serverTestURL)
+
+	result, err := replayer.Replay(context.Background(), DeadLetterQueueName("dead-letter-queue"), ReplaySettings{
+		Filter: func(d amqp.Delivery) bool {
+			return d.Headers[FailureReasonHeader] == "try later"
+		},
+	})
+
+	assert.Nil(t, err, "no error replaying")
+	assert.Equal(t, ReplayResult{Replayed: 1}, result, "message replayed")
+}
+
+func TestReplayUnroutable(t *testing.T) {
+	conn, err := amqp.Dial(serverTestURL)
+	if !assert.Nil(t, err, "no error connecting") {
+		return
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if !assert.Nil(t, err, "no error opening channel") {
+		return
+	}
+	defer ch.Close()
+
+	dlq := DeadLetterQueueName("replay-unroutable")
+
+	_, err = ch.QueueDeclare(dlq, false, true, false, false, nil)
+	assert.Nil(t, err, "no error declaring dead letter queue")
+
+	_, err = ch.QueuePurge(dlq, false)
+	assert.Nil(t, err, "no error purging dead letter queue")
+
+	err = ch.Publish("", dlq, false, false, amqp.Publishing{
+		Headers: amqp.Table{
+			OriginalExchangeHeader:   "",
+			OriginalRoutingKeyHeader: "replay-unroutable-deleted",
+		},
+		Body: []byte("lost?"),
+	})
+	assert.Nil(t, err, "no error publishing dead lettered message")
+
+	// Wait for the message to be in the queue.
+	time.Sleep(100 * time.Millisecond)
+
+	result, err := NewReplayer(serverTestURL).Replay(context.Background(), dlq, ReplaySettings{})
+
+	assert.Nil(t, err, "no error replaying")
+	assert.Equal(t, ReplayResult{Skipped: 1}, result, "unroutable message skipped")
+
+	// Wait for the message to be put back when the replayer closes it's
+	// channel.
+	time.Sleep(100 * time.Millisecond)
+
+	queue, err := ch.QueueInspect(dlq)
+	assert.Nil(t, err, "no error inspecting dead letter queue")
+	assert.Equal(t, 1, queue.Messages, "unroutable message left in dead letter queue")
+}
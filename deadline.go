@@ -0,0 +1,63 @@
+package amqprpc
+
+import (
+	"context"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// DeadlineHeader holds the time when the client stops waiting for the reply
+// to a request, as milliseconds since the Unix epoch.
+const DeadlineHeader = "X-Deadline"
+
+// Deadline returns the deadline set by the client in the DeadlineHeader of
+// d. The bool is false if d has no deadline.
+func Deadline(d amqp.Delivery) (time.Time, bool) {
+	var ms int64
+
+	switch v := d.Headers[DeadlineHeader].(type) {
+	case int64:
+		ms = v
+	case int32:
+		ms = int64(v)
+	case int:
+		ms = int64(v)
+	default:
+		return time.Time{}, false
+	}
+
+	return time.Unix(0, ms*int64(time.Millisecond)), true
+}
+
+// RemainingBudget returns the time left until the deadline of ctx. Inside a
+// handler this is the time left until the client stops waiting for the
+// reply. The bool is false if ctx has no deadline.
+func RemainingBudget(ctx context.Context) (time.Duration, bool) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0, false
+	}
+
+	return time.Until(deadline), true
+}
+
+// writeDeadline will set the DeadlineHeader on the publishing.
+func (r *Request) writeDeadline(deadline time.Time) {
+	if r.Publishing.Headers == nil {
+		r.Publishing.Headers = amqp.Table{}
+	}
+
+	r.Publishing.Headers[DeadlineHeader] = deadline.UnixNano() / int64(time.Millisecond)
+}
+
+// deadlineContext returns a copy of ctx which is canceled when the deadline
+// of d has passed. If d has no deadline ctx is returned as is.
+func deadlineContext(ctx context.Context, d amqp.Delivery) (context.Context, context.CancelFunc) {
+	deadline, ok := Deadline(d)
+	if !ok {
+		return ctx, func() {}
+	}
+
+	return context.WithDeadline(ctx, deadline)
+}
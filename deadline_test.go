@@ -0,0 +1,107 @@
+package amqprpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestDeadline(t *testing.T) {
+	r := NewRequest().WithTimeout(10 * time.Second)
+	r.startTimeout(r.deliveryDelay())
+
+	deadline, ok := Deadline(amqp.Delivery{Headers: r.Publishing.Headers})
+	assert.True(t, ok, "deadline is set")
+	assert.InDelta(t, float64(10*time.Second), float64(time.Until(deadline)), float64(time.Second), "deadline from timeout")
+	assert.Equal(t, "10000", r.Publishing.Expiration, "expiration from timeout")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	r = NewRequest().WithTimeout(10 * time.Second).WithContext(ctx)
+	r.startTimeout(r.deliveryDelay())
+
+	deadline, _ = Deadline(amqp.Delivery{Headers: r.Publishing.Headers})
+	contextDeadline, _ := ctx.Deadline()
+
+	assert.InDelta(t, float64(contextDeadline.UnixNano()), float64(deadline.UnixNano()), float64(10*time.Millisecond), "deadline from context")
+	assert.Equal(t, 10*time.Second, r.Timeout, "timeout is kept")
+	assert.NotEqual(t, "10000", r.Publishing.Expiration, "expiration from context")
+
+	r = NewRequest().WithTimeout(time.Second).WithDelay(time.Minute).WithHeaders(nil)
+	r.startTimeout(r.deliveryDelay())
+
+	deadline, ok = Deadline(amqp.Delivery{Headers: r.Publishing.Headers})
+	assert.True(t, ok, "deadline is set without headers")
+	assert.True(t, time.Until(deadline) > time.Minute, "deadline includes delay")
+
+	r = NewRequest().WithTimeout(time.Second)
+	r.stream = make(chan *amqp.Delivery)
+	r.startTimeout(r.deliveryDelay())
+
+	_, ok = Deadline(amqp.Delivery{Headers: r.Publishing.Headers})
+	assert.False(t, ok, "no deadline for streams")
+	assert.Equal(t, "1000", r.Publishing.Expiration, "expiration from timeout for streams")
+
+	r = NewRequest().WithTimeout(time.Second).WithResponse(false)
+	r.startTimeout(r.deliveryDelay())
+
+	_, ok = Deadline(amqp.Delivery{Headers: r.Publishing.Headers})
+	assert.False(t, ok, "no deadline without reply")
+	assert.Equal(t, "1000", r.Publishing.Expiration, "expiration from timeout without reply")
+}
+
+func TestDeadlineContext(t *testing.T) {
+	_, ok := Deadline(amqp.Delivery{})
+	assert.False(t, ok, "no deadline without header")
+
+	ctx, cancel := deadlineContext(context.Background(), amqp.Delivery{})
+	cancel()
+
+	_, ok = RemainingBudget(ctx)
+	assert.False(t, ok, "no budget without deadline")
+	assert.Nil(t, ctx.Err(), "context without deadline not canceled")
+
+	deadline := time.Now().Add(time.Minute)
+
+	ctx, cancel = deadlineContext(context.Background(), amqp.Delivery{
+		Headers: amqp.Table{DeadlineHeader: deadline.UnixNano() / int64(time.Millisecond)},
+	})
+	defer cancel()
+
+	remaining, ok := RemainingBudget(ctx)
+	assert.True(t, ok, "budget from deadline")
+	assert.InDelta(t, float64(time.Minute), float64(remaining), float64(time.Second), "correct budget")
+
+	ctx, cancel = deadlineContext(context.Background(), amqp.Delivery{
+		Headers: amqp.Table{DeadlineHeader: time.Now().Add(-time.Second).UnixNano() / int64(time.Millisecond)},
+	})
+	defer cancel()
+
+	assert.Equal(t, context.DeadlineExceeded, ctx.Err(), "passed deadline is done")
+}
+
+func TestHandlerDeadline(t *testing.T) {
+	remaining := make(chan time.Duration, 1)
+
+	s := NewServer(serverTestURL, QosConfig{})
+	s.Bind(DirectBinding("deadline", func(ctx context.Context, rw *ResponseWriter, d amqp.Delivery) {
+		budget, _ := RemainingBudget(ctx)
+		remaining <- budget
+	}))
+
+	stop := startAndWait(s)
+	defer stop()
+
+	client := NewClient(serverTestURL, QosConfig{})
+	defer client.Stop()
+
+	_, err := client.Send(NewRequest().WithRoutingKey("deadline").WithTimeout(5 * time.Second))
+	assert.Nil(t, err, "no error from request")
+
+	budget := <-remaining
+	assert.True(t, budget > 0 && budget <= 5*time.Second, "handler has the remaining budget of the request")
+}
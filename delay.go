@@ -0,0 +1,209 @@
+package amqprpc
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	// DelayQueuePrefix is the prefix of the queues used to hold delayed
+	// requests.
+	DelayQueuePrefix = "amq-rpc.delay."
+
+	// delayQueueExpiresMargin is how long an unused delay queue is kept after
+	// the last request in it has been delivered. Declared delay queues are
+	// declared again after half of it to keep them from expiring.
+	delayQueueExpiresMargin = time.Minute
+)
+
+// delayBuckets are the delays of the delay queues. A request is published to
+// the queue of the smallest delay not shorter than it's own delay, longer
+// delays than the last bucket use a queue per started day.
+var delayBuckets = []time.Duration{
+	time.Second,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+	time.Minute,
+	5 * time.Minute,
+	10 * time.Minute,
+	30 * time.Minute,
+	time.Hour,
+	3 * time.Hour,
+	6 * time.Hour,
+	12 * time.Hour,
+	24 * time.Hour,
+}
+
+// delayBucket returns the delay of the delay queue for requests delayed for
+// delay.
+func delayBucket(delay time.Duration) time.Duration {
+	for _, bucket := range delayBuckets {
+		if delay <= bucket {
+			return bucket
+		}
+	}
+
+	day := 24 * time.Hour
+
+	return (delay + day - 1) / day * day
+}
+
+// DelayQueueName returns the name of the queue holding requests to exchange
+// and routingKey delayed for delay.
+func DelayQueueName(exchange, routingKey string, delay time.Duration) string {
+	return fmt.Sprintf("%s%d.%s.%s", DelayQueuePrefix, delayBucket(delay)/time.Millisecond, exchange, routingKey)
+}
+
+/*
+WithDelayedMessageExchange will make the client publish delayed requests to
+an exchange of the type x-delayed-message, provided by the RabbitMQ delayed
+message exchange plugin, instead of using delay queues. The exchange is
+declared by the client and bound to the exchange of each delayed request.
+
+Without the plugin, each delayed request is published to a delay queue named
+by DelayQueueName() with it's delay as expiration. The queue dead letters the
+requests to the exchange and routing key of the request when they expire.
+There is one queue for each of a fixed set of delays, from one second to one
+day, and a request is published to the first queue with a delay at least as
+long as it's own. Since the broker only expires requests at the head of a
+queue a request may be held back by an earlier request in the same queue, but
+never for longer than the delay of the queue. The request timeout therefore
+starts after the delay of the queue. The queues are removed by the broker when
+they've been unused for a while.
+
+Requests to the default exchange are always published to a delay queue since
+the default exchange can't be bound to another exchange. The expiration
+set from the request timeout is removed from delayed requests.
+*/
+func (c *Client) WithDelayedMessageExchange(exchange string) *Client {
+	c.delayedMessageExchange = exchange
+
+	return c
+}
+
+// destination returns the exchange, the routing key and the publishing to use
+// when publishing the request. For delayed requests the delay queue or the
+// delayed message exchange is declared. Bindings already made to the delayed
+// message exchange on the channel are kept in bound and the delay queues
+// declared on the channel in declared.
+func (c *Client) destination(ch *amqp.Channel, p *pendingRequest, bound map[string]struct{}, declared map[string]time.Time) (string, string, amqp.Publishing, error) {
+	r := p.request
+
+	delay := p.delay
+	if delay == 0 {
+		return r.Exchange, r.RoutingKey, p.publishing, nil
+	}
+
+	publishing := p.publishing
+
+	// The expiration from the timeout would cut the delay short and it's
+	// removed by the broker when dead lettering anyway.
+	publishing.Expiration = ""
+
+	if c.useDelayedMessageExchange(r) {
+		if err := c.bindDelayedMessageExchange(ch, r, bound); err != nil {
+			return "", "", publishing, err
+		}
+
+		headers := amqp.Table{}
+		for k, v := range p.publishing.Headers {
+			headers[k] = v
+		}
+
+		headers["x-delay"] = int64(delay / time.Millisecond)
+		publishing.Headers = headers
+
+		return c.delayedMessageExchange, r.RoutingKey, publishing, nil
+	}
+
+	if err := declareDelayQueue(ch, r, delay, declared); err != nil {
+		return "", "", publishing, err
+	}
+
+	publishing.Expiration = fmt.Sprintf("%d", delay/time.Millisecond)
+
+	return "", DelayQueueName(r.Exchange, r.RoutingKey, delay), publishing, nil
+}
+
+// declareDelayQueue will declare the delay queue for requests like r delayed
+// for delay unless it's in declared. The broker only counts declaring as using
+// the queue so it's declared again before it could expire.
+func declareDelayQueue(ch *amqp.Channel, r *Request, delay time.Duration, declared map[string]time.Time) error {
+	queueName := DelayQueueName(r.Exchange, r.RoutingKey, delay)
+
+	if at, ok := declared[queueName]; ok && time.Since(at) < delayQueueExpiresMargin/2 {
+		return nil
+	}
+
+	bucket := delayBucket(delay)
+
+	_, err := ch.QueueDeclare(
+		queueName,
+		true,  // durable
+		false, // delete when unused
+		false, // exclusive
+		false, // no wait
+		amqp.Table{
+			"x-message-ttl":             int64(bucket / time.Millisecond),
+			"x-expires":                 int64((bucket + delayQueueExpiresMargin) / time.Millisecond),
+			"x-dead-letter-exchange":    r.Exchange,
+			"x-dead-letter-routing-key": r.RoutingKey,
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	declared[queueName] = time.Now()
+
+	return nil
+}
+
+// useDelayedMessageExchange tells if the delayed request r is published to the
+// delayed message exchange rather than to a delay queue.
+func (c *Client) useDelayedMessageExchange(r *Request) bool {
+	return c.delayedMessageExchange != "" && r.Exchange != ""
+}
+
+// maxDeliveryDelay returns the longest time the broker may hold p before it's
+// delivered. A request in a delay queue can be held back by an earlier request
+// with a longer delay, but never past the delay of the queue.
+func (c *Client) maxDeliveryDelay(p *pendingRequest) time.Duration {
+	if p.delay == 0 || c.useDelayedMessageExchange(p.request) {
+		return p.delay
+	}
+
+	return delayBucket(p.delay)
+}
+
+func (c *Client) bindDelayedMessageExchange(ch *amqp.Channel, r *Request, bound map[string]struct{}) error {
+	key := r.Exchange + "/" + r.RoutingKey
+	if _, ok := bound[key]; ok {
+		return nil
+	}
+
+	err := ch.ExchangeDeclare(
+		c.delayedMessageExchange,
+		"x-delayed-message",
+		true,  // durable
+		false, // auto delete
+		false, // internal
+		false, // no wait
+		amqp.Table{"x-delayed-type": "direct"},
+	)
+	if err != nil {
+		return err
+	}
+
+	err = ch.ExchangeBind(r.Exchange, r.RoutingKey, c.delayedMessageExchange, false, nil)
+	if err != nil {
+		return err
+	}
+
+	bound[key] = struct{}{}
+
+	return nil
+}
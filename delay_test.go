@@ -0,0 +1,109 @@
+package amqprpc
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestDelay(t *testing.T) {
+	r := NewRequest()
+	assert.Equal(t, time.Duration(0), r.deliveryDelay(), "no delay by default")
+
+	r.WithDelay(1500 * time.Microsecond)
+	assert.Equal(t, 2*time.Millisecond, r.deliveryDelay(), "delay rounded to milliseconds")
+
+	r.WithDeliverAt(time.Now().Add(time.Minute))
+	assert.InDelta(t, float64(time.Minute), float64(r.deliveryDelay()), float64(time.Second), "delay until deliver at")
+	assert.Equal(t, time.Duration(0), r.delay, "deliver at replaces delay")
+
+	r.WithDeliverAt(time.Now().Add(-time.Minute))
+	assert.Equal(t, time.Duration(0), r.deliveryDelay(), "no delay when deliver at has passed")
+
+	assert.Equal(t, "amq-rpc.delay.5000.amq.direct.myqueue", DelayQueueName("amq.direct", "myqueue", 5*time.Second), "delay queue name")
+	assert.Equal(t, "amq-rpc.delay.5000.amq.direct.myqueue", DelayQueueName("amq.direct", "myqueue", 1234*time.Millisecond), "delay queue name for bucket")
+}
+
+func TestDelayBucket(t *testing.T) {
+	assert.Equal(t, time.Second, delayBucket(time.Millisecond), "shortest bucket")
+	assert.Equal(t, time.Second, delayBucket(time.Second), "exact bucket")
+	assert.Equal(t, 5*time.Second, delayBucket(time.Second+time.Millisecond), "next bucket")
+	assert.Equal(t, 24*time.Hour, delayBucket(23*time.Hour), "longest bucket")
+	assert.Equal(t, 72*time.Hour, delayBucket(48*time.Hour+time.Minute), "bucket per started day")
+}
+
+func TestClientMaxDeliveryDelay(t *testing.T) {
+	c := NewClient(clientTestURL, QosConfig{})
+
+	p := newPendingRequest(NewRequest().WithExchange("amq.direct").WithDelay(61 * time.Second))
+	assert.Equal(t, 5*time.Minute, c.maxDeliveryDelay(p), "held at most the delay of the queue")
+
+	p = newPendingRequest(NewRequest().WithExchange("amq.direct"))
+	assert.Equal(t, time.Duration(0), c.maxDeliveryDelay(p), "not held without delay")
+
+	c.WithDelayedMessageExchange("amq-rpc.delayed")
+
+	p = newPendingRequest(NewRequest().WithExchange("amq.direct").WithDelay(61 * time.Second))
+	assert.Equal(t, 61*time.Second, c.maxDeliveryDelay(p), "exact delay with delayed message exchange")
+
+	p = newPendingRequest(NewRequest().WithDelay(61 * time.Second))
+	assert.Equal(t, 5*time.Minute, c.maxDeliveryDelay(p), "default exchange always uses delay queue")
+}
+
+func TestDeclareDelayQueueCached(t *testing.T) {
+	r := NewRequest().WithExchange("amq.direct").WithRoutingKey("myqueue")
+	declared := map[string]time.Time{
+		DelayQueueName("amq.direct", "myqueue", time.Second): time.Now(),
+	}
+
+	// The channel isn't used for a queue declared recently.
+	assert.Nil(t, declareDelayQueue(nil, r, 500*time.Millisecond, declared), "no error")
+}
+
+func TestClientDestinationWithoutDelay(t *testing.T) {
+	c := NewClient(clientTestURL, QosConfig{})
+	r := NewRequest().WithExchange("amq.direct").WithRoutingKey("myqueue")
+	r.Publishing.Expiration = "1000"
+
+	exchange, routingKey, publishing, err := c.destination(nil, newPendingRequest(r), map[string]struct{}{}, map[string]time.Time{})
+
+	assert.Nil(t, err, "no error")
+	assert.Equal(t, "amq.direct", exchange, "published to request exchange")
+	assert.Equal(t, "myqueue", routingKey, "published with request routing key")
+	assert.Equal(t, "1000", publishing.Expiration, "expiration kept")
+}
+
+func TestClientDelay(t *testing.T) {
+	received := make(chan time.Time, 1)
+
+	s := NewServer(clientTestURL, QosConfig{})
+	s.Bind(DirectBinding("delayed-queue", func(ctx context.Context, rw *ResponseWriter, d amqp.Delivery) {
+		received <- time.Now()
+		fmt.Fprintf(rw, "Got message: %s", d.Body)
+	}))
+
+	stop := startAndWait(s)
+	defer stop()
+
+	client := NewClient(clientTestURL, QosConfig{})
+	defer client.Stop()
+
+	sent := time.Now()
+
+	reply, err := client.Send(
+		NewRequest().
+			WithExchange("amq.direct").
+			WithRoutingKey("delayed-queue").
+			WithBody("later").
+			WithDelay(500 * time.Millisecond).
+			WithTimeout(time.Second),
+	)
+
+	assert.Nil(t, err, "no error from delayed request")
+	assert.Equal(t, []byte("Got message: later"), reply.Body, "correct body in response")
+	assert.True(t, (<-received).Sub(sent) >= 500*time.Millisecond, "request delivered after delay")
+}
@@ -0,0 +1,128 @@
+package amqprpc
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// HealthCheckSuffix is appended to the routing key passed to
+// Server.WithHealthCheck() and Client.Ping() to get the routing key of the
+// health check endpoint.
+const HealthCheckSuffix = ".__health"
+
+// HealthStatus is the response from the health check endpoint of a server.
+type HealthStatus struct {
+	// StartedAt is when ListenAndServe was called.
+	StartedAt time.Time `json:"started_at"`
+
+	// Uptime is the time since ListenAndServe was called.
+	Uptime time.Duration `json:"uptime"`
+
+	// Queues holds the name of all the queues the server is consuming from,
+	// including the queue of the health check.
+	Queues []string `json:"queues"`
+
+	// InFlight is the number of handlers currently running.
+	InFlight int64 `json:"in_flight"`
+
+	// Connected is true if the server is connected to the message bus.
+	Connected bool `json:"connected"`
+
+	// ReconnectAttempt is the number of failed attempts to connect in a row.
+	ReconnectAttempt int `json:"reconnect_attempt"`
+
+	// Workers holds the WorkerStats for each queue the server is consuming
+	// from.
+	Workers map[string]WorkerStats `json:"workers"`
+}
+
+// HealthCheckRoutingKey returns the routing key used for the health check
+// endpoint for routingKey.
+func HealthCheckRoutingKey(routingKey string) string {
+	return routingKey + HealthCheckSuffix
+}
+
+/*
+WithHealthCheck will bind a health check endpoint on the default direct
+exchange with the routing key returned by HealthCheckRoutingKey(routingKey).
+The endpoint answers with a JSON encoded HealthStatus. Since it's a handler
+like any other it will only answer when the server is actually consuming,
+which makes it a good fit for liveness probes.
+
+	server := NewServer(url)
+	server.WithHealthCheck("myservice")
+
+	client := NewClient(url)
+	status, latency, err := client.Ping(ctx, "myservice")
+
+The middlewares added to the server will also be executed for the health
+check.
+*/
+func (s *Server) WithHealthCheck(routingKey string) *Server {
+	s.Bind(DirectBinding(HealthCheckRoutingKey(routingKey), s.healthHandler))
+
+	return s
+}
+
+// Health returns the current HealthStatus of the server.
+func (s *Server) Health() HealthStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	status := HealthStatus{
+		StartedAt:        s.startedAt,
+		Queues:           append([]string{}, s.boundQueues...),
+		InFlight:         atomic.LoadInt64(&s.inFlight),
+		Connected:        atomic.LoadInt32(&s.isConnected) == 1,
+		ReconnectAttempt: s.reconnectAttempt,
+		Workers:          s.workerStats(),
+	}
+
+	if !s.startedAt.IsZero() {
+		status.Uptime = time.Since(s.startedAt)
+	}
+
+	return status
+}
+
+func (s *Server) healthHandler(ctx context.Context, rw *ResponseWriter, d amqp.Delivery) {
+	body, err := json.Marshal(s.Health())
+	if err != nil {
+		rw.WriteError(NewRemoteError(CodeInternal, err.Error()))
+		return
+	}
+
+	rw.Publishing().ContentType = ContentTypeJSON
+	_, _ = rw.Write(body)
+}
+
+// Ping will call the health check endpoint bound with
+// Server.WithHealthCheck(routingKey) and return the HealthStatus of the server
+// answering together with the round trip latency.
+func (c *Client) Ping(ctx context.Context, routingKey string) (*HealthStatus, time.Duration, error) {
+	start := time.Now()
+
+	d, err := c.SendContext(ctx, NewRequest().WithRoutingKey(HealthCheckRoutingKey(routingKey)))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	latency := time.Since(start)
+
+	if remoteErr := ParseRemoteError(d); remoteErr != nil {
+		return nil, latency, remoteErr
+	}
+
+	status := &HealthStatus{}
+
+	err = Decode(d, status)
+	if err != nil {
+		return nil, latency, err
+	}
+
+	return status, latency, nil
+}
@@ -0,0 +1,57 @@
+package amqprpc
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthHandler(t *testing.T) {
+	s := NewServer(serverTestURL, QosConfig{})
+
+	rw := &ResponseWriter{
+		publishing: &amqp.Publishing{},
+	}
+
+	s.healthHandler(context.Background(), rw, amqp.Delivery{})
+
+	status := HealthStatus{}
+	err := json.Unmarshal(rw.Publishing().Body, &status)
+
+	assert.Nil(t, err, "health status is JSON")
+	assert.Equal(t, ContentTypeJSON, rw.Publishing().ContentType, "content type is set")
+	assert.Equal(t, false, status.Connected, "not connected before started")
+	assert.Equal(t, 0, len(status.Queues), "no queues before started")
+	assert.Equal(t, time.Duration(0), status.Uptime, "no uptime before started")
+	assert.Equal(t, "myservice.__health", HealthCheckRoutingKey("myservice"), "correct routing key")
+}
+
+func TestPing(t *testing.T) {
+	s := NewServer(serverTestURL, QosConfig{}).WithHealthCheck("myservice")
+	s.Bind(DirectBinding("myqueue", func(ctx context.Context, rw *ResponseWriter, d amqp.Delivery) {}))
+
+	stop := startAndWait(s)
+	defer stop()
+
+	client := NewClient(serverTestURL, QosConfig{})
+	defer client.Stop()
+
+	status, latency, err := client.Ping(context.Background(), "myservice")
+
+	assert.Nil(t, err, "no error from ping")
+	assert.True(t, latency > 0, "latency is measured")
+	assert.True(t, status.Connected, "server is connected")
+	assert.True(t, status.Uptime > 0, "server has uptime")
+	assert.Equal(t, int64(1), status.InFlight, "only the health check is in flight")
+	assert.Equal(t, []string{"myservice.__health", "myqueue"}, status.Queues, "bound queues are listed")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, _, err = client.Ping(ctx, "not-a-service")
+	assert.NotNil(t, err, "no answer from unknown service")
+}
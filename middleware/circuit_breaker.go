@@ -0,0 +1,241 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	amqprpc "github.com/cuiweiqiang/amqp-rpc"
+)
+
+// ErrCircuitOpen is returned by the CircuitBreaker middleware when a request
+// is not sent because the circuit for it's exchange and routing key is open.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitState is the state of a circuit in the CircuitBreaker middleware.
+type CircuitState int
+
+const (
+	// CircuitClosed means that requests are sent as usual.
+	CircuitClosed CircuitState = iota
+
+	// CircuitOpen means that requests fail fast with ErrCircuitOpen.
+	CircuitOpen
+
+	// CircuitHalfOpen means that one probe request is sent to see if the
+	// circuit can be closed again. Other requests fail fast while waiting for
+	// the probe.
+	CircuitHalfOpen
+)
+
+// String implements the fmt.Stringer interface.
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+
+	return "unknown"
+}
+
+// CircuitBreakerSettings is the configuration used by the CircuitBreaker
+// middleware.
+type CircuitBreakerSettings struct {
+	// FailureThreshold is the number of failures in a row that will open the
+	// circuit. Defaults to 5.
+	FailureThreshold int
+
+	// OpenTimeout is the time a circuit stays open before a probe request is
+	// allowed. Defaults to 10 seconds.
+	OpenTimeout time.Duration
+
+	// IsFailure tells if the error returned for a request is a failure. If
+	// nil, all errors except the ones from a canceled context are failures.
+	IsFailure func(error) bool
+
+	// OnStateChange is called each time a circuit changes state. The key is
+	// the exchange and routing key separated by a slash.
+	OnStateChange func(key string, from, to CircuitState)
+}
+
+// circuit holds the state for one exchange and routing key.
+type circuit struct {
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	probing  bool
+
+	// generation is increased each time the state changes. Only results
+	// from requests allowed in the current generation are counted, so a
+	// request sent before the circuit opened can't close it.
+	generation uint64
+}
+
+// setState will change the state of the circuit and start a new generation.
+func (c *circuit) setState(state CircuitState) {
+	c.state = state
+	c.generation++
+}
+
+type circuitBreaker struct {
+	settings CircuitBreakerSettings
+	circuits map[string]*circuit
+	mu       sync.Mutex
+}
+
+/*
+CircuitBreaker returns a client middleware which keeps one circuit per exchange
+and routing key. When FailureThreshold requests in a row have failed the
+circuit opens and all requests fail fast with ErrCircuitOpen. After OpenTimeout
+one probe request is sent and if it succeeds the circuit is closed again.
+
+	c := NewClient(url).AddMiddleware(
+		middleware.CircuitBreaker(middleware.CircuitBreakerSettings{
+			FailureThreshold: 3,
+			OpenTimeout:      30 * time.Second,
+			OnStateChange: func(key string, from, to middleware.CircuitState) {
+				log.Printf("circuit %s changed from %s to %s", key, from, to)
+			},
+		}),
+	)
+*/
+func CircuitBreaker(s CircuitBreakerSettings) amqprpc.ClientMiddlewareFunc {
+	if s.FailureThreshold <= 0 {
+		s.FailureThreshold = 5
+	}
+
+	if s.OpenTimeout <= 0 {
+		s.OpenTimeout = 10 * time.Second
+	}
+
+	if s.IsFailure == nil {
+		s.IsFailure = func(err error) bool {
+			return err != context.Canceled && err != context.DeadlineExceeded
+		}
+	}
+
+	cb := &circuitBreaker{
+		settings: s,
+		circuits: map[string]*circuit{},
+	}
+
+	return func(next amqprpc.SendFunc) amqprpc.SendFunc {
+		return func(r *amqprpc.Request) (*amqp.Delivery, error) {
+			key := r.Exchange + "/" + r.RoutingKey
+
+			generation, ok := cb.allow(key)
+			if !ok {
+				return nil, ErrCircuitOpen
+			}
+
+			d, err := next(r)
+
+			cb.report(key, generation, err)
+
+			return d, err
+		}
+	}
+}
+
+// allow tells if a request for key may be sent and returns the generation of
+// the circuit the request is sent in.
+func (cb *circuitBreaker) allow(key string) (uint64, bool) {
+	cb.mu.Lock()
+
+	c, ok := cb.circuits[key]
+	if !ok {
+		c = &circuit{state: CircuitClosed}
+		cb.circuits[key] = c
+	}
+
+	from := c.state
+	allowed := true
+
+	switch c.state {
+	case CircuitOpen:
+		if time.Since(c.openedAt) < cb.settings.OpenTimeout {
+			allowed = false
+			break
+		}
+
+		c.setState(CircuitHalfOpen)
+		c.probing = true
+	case CircuitHalfOpen:
+		if c.probing {
+			allowed = false
+			break
+		}
+
+		c.probing = true
+	}
+
+	to := c.state
+	generation := c.generation
+
+	cb.mu.Unlock()
+
+	cb.stateChanged(key, from, to)
+
+	return generation, allowed
+}
+
+// report will update the circuit for key with the result of a request sent
+// in generation. Results from earlier generations are ignored.
+func (cb *circuitBreaker) report(key string, generation uint64, err error) {
+	failed := err != nil && cb.settings.IsFailure(err)
+
+	cb.mu.Lock()
+
+	c := cb.circuits[key]
+	from := c.state
+
+	if c.generation != generation {
+		cb.mu.Unlock()
+		return
+	}
+
+	switch {
+	case err != nil && !failed:
+		// The request didn't tell us anything about the circuit, i.e. it was
+		// canceled. Allow a new probe if this was the probe.
+		c.probing = false
+	case failed && c.state == CircuitHalfOpen:
+		c.setState(CircuitOpen)
+		c.openedAt = time.Now()
+		c.probing = false
+	case failed:
+		c.failures++
+
+		if c.state == CircuitClosed && c.failures >= cb.settings.FailureThreshold {
+			c.setState(CircuitOpen)
+			c.openedAt = time.Now()
+		}
+	case c.state != CircuitClosed:
+		c.setState(CircuitClosed)
+		c.failures = 0
+		c.probing = false
+	default:
+		c.failures = 0
+	}
+
+	to := c.state
+
+	cb.mu.Unlock()
+
+	cb.stateChanged(key, from, to)
+}
+
+func (cb *circuitBreaker) stateChanged(key string, from, to CircuitState) {
+	if from == to || cb.settings.OnStateChange == nil {
+		return
+	}
+
+	cb.settings.OnStateChange(key, from, to)
+}
@@ -0,0 +1,123 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+
+	amqprpc "github.com/cuiweiqiang/amqp-rpc"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		sent    int
+		fail    = true
+		changes []CircuitState
+	)
+
+	send := CircuitBreaker(CircuitBreakerSettings{
+		FailureThreshold: 2,
+		OpenTimeout:      20 * time.Millisecond,
+		OnStateChange: func(key string, from, to CircuitState) {
+			assert.Equal("/broken", key, "state change for correct key")
+			changes = append(changes, to)
+		},
+	})(func(r *amqprpc.Request) (*amqp.Delivery, error) {
+		if r.RoutingKey != "broken" {
+			return &amqp.Delivery{}, nil
+		}
+
+		sent++
+
+		if fail {
+			return nil, amqprpc.ErrTimeout
+		}
+
+		return &amqp.Delivery{}, nil
+	})
+
+	broken := amqprpc.NewRequest().WithRoutingKey("broken")
+
+	for i := 0; i < 2; i++ {
+		_, err := send(broken)
+		assert.Equal(amqprpc.ErrTimeout, err, "errors returned while closed")
+	}
+
+	_, err := send(broken)
+	assert.Equal(ErrCircuitOpen, err, "fail fast when open")
+	assert.Equal(2, sent, "request not sent when open")
+
+	_, err = send(amqprpc.NewRequest().WithRoutingKey("working"))
+	assert.Nil(err, "other routing keys are not affected")
+
+	time.Sleep(30 * time.Millisecond)
+
+	_, err = send(broken)
+	assert.Equal(amqprpc.ErrTimeout, err, "probe sent when half open")
+	assert.Equal(3, sent, "probe request sent")
+
+	_, err = send(broken)
+	assert.Equal(ErrCircuitOpen, err, "open again after failed probe")
+
+	time.Sleep(30 * time.Millisecond)
+
+	fail = false
+
+	_, err = send(broken)
+	assert.Nil(err, "successful probe")
+
+	_, err = send(broken)
+	assert.Nil(err, "closed after successful probe")
+
+	assert.Equal(
+		[]CircuitState{CircuitOpen, CircuitHalfOpen, CircuitOpen, CircuitHalfOpen, CircuitClosed},
+		changes,
+		"all state changes reported",
+	)
+}
+
+func TestCircuitBreakerStaleSuccess(t *testing.T) {
+	var (
+		release = make(chan struct{})
+		started = make(chan struct{})
+		states  []CircuitState
+	)
+
+	send := CircuitBreaker(CircuitBreakerSettings{
+		FailureThreshold: 2,
+		OpenTimeout:      time.Hour,
+		OnStateChange: func(key string, from, to CircuitState) {
+			states = append(states, to)
+		},
+	})(func(r *amqprpc.Request) (*amqp.Delivery, error) {
+		if r.Publishing.CorrelationId == "slow" {
+			close(started)
+			<-release
+
+			return &amqp.Delivery{}, nil
+		}
+
+		return nil, amqprpc.ErrTimeout
+	})
+
+	done := make(chan error)
+	go func() {
+		_, err := send(amqprpc.NewRequest().WithCorrelationID("slow"))
+		done <- err
+	}()
+
+	<-started
+
+	_, _ = send(amqprpc.NewRequest())
+	_, _ = send(amqprpc.NewRequest())
+
+	close(release)
+	assert.Nil(t, <-done, "slow request succeeded")
+
+	_, err := send(amqprpc.NewRequest())
+	assert.Equal(t, ErrCircuitOpen, err, "success from before the circuit opened doesn't close it")
+	assert.Equal(t, []CircuitState{CircuitOpen}, states, "circuit only opened")
+}
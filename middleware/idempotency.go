@@ -0,0 +1,243 @@
+package middleware
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	amqprpc "github.com/cuiweiqiang/amqp-rpc"
+)
+
+const (
+	// IdempotentReplayHeader is set to true on responses replayed from the
+	// IdempotencyStore instead of running the handler.
+	IdempotentReplayHeader = "X-Idempotent-Replay"
+)
+
+// CachedResponse is the response of a handler stored in an
+// IdempotencyStore.
+type CachedResponse struct {
+	Headers         amqp.Table `json:"headers"`
+	ContentType     string     `json:"content_type"`
+	ContentEncoding string     `json:"content_encoding"`
+	Type            string     `json:"type"`
+	Body            []byte     `json:"body"`
+}
+
+// IdempotencyStore stores the responses of handlers by the idempotency key of
+// the request. Implementations must be safe for concurrent use and decide for
+// themselves for how long a response is kept.
+type IdempotencyStore interface {
+	// Get returns the response stored for key. The bool is false if no
+	// response is stored.
+	Get(key string) (*CachedResponse, bool, error)
+
+	// Set stores the response for key.
+	Set(key string, response *CachedResponse) error
+}
+
+// IdempotencySettings is the configuration used by the Idempotency
+// middleware.
+type IdempotencySettings struct {
+	// Store is where the responses are stored. If nil, a
+	// MemoryIdempotencyStore keeping 10000 responses for an hour is used.
+	Store IdempotencyStore
+
+	// ShouldStore tells if a response should be stored. If nil, all
+	// responses are stored except errors marked as retryable since the
+	// request is expected to be sent again.
+	ShouldStore func(p *amqp.Publishing) bool
+}
+
+// IdempotencyKey returns the key used to deduplicate d. The
+// IdempotencyKeyHeader is used if set, otherwise the message ID. An empty
+// string is returned if neither is set.
+func IdempotencyKey(d amqp.Delivery) string {
+	if key, ok := d.Headers[IdempotencyKeyHeader].(string); ok && key != "" {
+		return key
+	}
+
+	return d.MessageId
+}
+
+func defaultShouldStore(p *amqp.Publishing) bool {
+	remoteErr := amqprpc.ParseRemoteError(&amqp.Delivery{
+		Headers: p.Headers,
+		Body:    p.Body,
+	})
+
+	return remoteErr == nil || !remoteErr.Retryable
+}
+
+/*
+Idempotency returns a server middleware which will store the response of each
+request with an idempotency key, see IdempotencyKey(). If a request with the
+same key is received again, i.e. when RabbitMQ redelivers a message after a
+consumer crashed or when a client retries, the stored response is replayed
+instead of running the handler again. Replayed responses have the
+IdempotentReplayHeader set.
+
+	server := NewServer(url)
+	server.AddMiddleware(middleware.Idempotency(middleware.IdempotencySettings{
+		Store: middleware.NewMemoryIdempotencyStore(10000, time.Hour),
+	}))
+
+Requests with the same key handled at the same time by the same server will
+wait for the first one to finish. If the context is done while waiting a
+retryable error is returned. Requests without a key are always handled. Only
+the final response is stored, partial responses flushed by a streaming handler
+are not replayed. Nor is the response if the handler nacked or rejected the
+delivery, since it will be redelivered or dead lettered.
+*/
+func Idempotency(s IdempotencySettings) amqprpc.ServerMiddlewareFunc {
+	if s.Store == nil {
+		s.Store = NewMemoryIdempotencyStore(10000, time.Hour)
+	}
+
+	if s.ShouldStore == nil {
+		s.ShouldStore = defaultShouldStore
+	}
+
+	var (
+		mu       sync.Mutex
+		inFlight = map[string]chan struct{}{}
+	)
+
+	return func(next amqprpc.HandlerFunc) amqprpc.HandlerFunc {
+		return func(ctx context.Context, rw *amqprpc.ResponseWriter, d amqp.Delivery) {
+			key := IdempotencyKey(d)
+			if key == "" {
+				next(ctx, rw, d)
+				return
+			}
+
+			// Wait for any request with the same key to finish.
+			for {
+				mu.Lock()
+				done, ok := inFlight[key]
+				if !ok {
+					inFlight[key] = make(chan struct{})
+				}
+				mu.Unlock()
+
+				if !ok {
+					break
+				}
+
+				select {
+				case <-done:
+				case <-ctx.Done():
+					rw.WriteError(waitError(ctx.Err()))
+					return
+				}
+			}
+
+			defer func() {
+				mu.Lock()
+				close(inFlight[key])
+				delete(inFlight, key)
+				mu.Unlock()
+			}()
+
+			cached, ok, err := s.Store.Get(key)
+			if err != nil {
+				log.Printf("could not get response for idempotency key %s: %s", key, err.Error())
+			}
+
+			if ok {
+				replay(rw, cached)
+				return
+			}
+
+			if d.Acknowledger != nil {
+				d.Acknowledger = &nackAwareAcknowledger{ch: d.Acknowledger}
+			}
+
+			next(ctx, rw, d)
+
+			if a, ok := d.Acknowledger.(*nackAwareAcknowledger); ok && a.nacked {
+				return
+			}
+
+			p := rw.Publishing()
+			if !s.ShouldStore(p) {
+				return
+			}
+
+			// Copy the headers and the body since the publishing is still
+			// used by the server.
+			headers := amqp.Table{}
+			for header, value := range p.Headers {
+				headers[header] = value
+			}
+
+			err = s.Store.Set(key, &CachedResponse{
+				Headers:         headers,
+				ContentType:     p.ContentType,
+				ContentEncoding: p.ContentEncoding,
+				Type:            p.Type,
+				Body:            append([]byte{}, p.Body...),
+			})
+			if err != nil {
+				log.Printf("could not store response for idempotency key %s: %s", key, err.Error())
+			}
+		}
+	}
+}
+
+func replay(rw *amqprpc.ResponseWriter, cached *CachedResponse) {
+	p := rw.Publishing()
+	p.ContentType = cached.ContentType
+	p.ContentEncoding = cached.ContentEncoding
+	p.Type = cached.Type
+
+	for header, value := range cached.Headers {
+		rw.WriteHeader(header, value)
+	}
+
+	rw.WriteHeader(IdempotentReplayHeader, true)
+
+	_, _ = rw.Write(cached.Body)
+}
+
+// waitError returns the error written when the context is done while waiting
+// for a request with the same idempotency key. It's retryable since the
+// response will most likely be stored when the request is sent again.
+func waitError(err error) *amqprpc.RemoteError {
+	code := amqprpc.CodeCanceled
+	if err == context.DeadlineExceeded {
+		code = amqprpc.CodeDeadlineExceeded
+	}
+
+	return &amqprpc.RemoteError{
+		Code:      code,
+		Message:   "waiting for request with same idempotency key: " + err.Error(),
+		Retryable: true,
+	}
+}
+
+// nackAwareAcknowledger wraps the acknowledger of a delivery to tell if the
+// handler nacked or rejected it.
+type nackAwareAcknowledger struct {
+	ch     amqp.Acknowledger
+	nacked bool
+}
+
+func (a *nackAwareAcknowledger) Ack(tag uint64, multiple bool) error {
+	return a.ch.Ack(tag, multiple)
+}
+
+func (a *nackAwareAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.nacked = true
+
+	return a.ch.Nack(tag, multiple, requeue)
+}
+
+func (a *nackAwareAcknowledger) Reject(tag uint64, requeue bool) error {
+	a.nacked = true
+
+	return a.ch.Reject(tag, requeue)
+}
@@ -0,0 +1,247 @@
+package middleware
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// MemoryIdempotencyStore is an IdempotencyStore keeping the responses in
+// memory. When full the least recently used response is evicted and
+// responses older than the TTL are never returned.
+type MemoryIdempotencyStore struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	items    map[string]*list.Element
+	order    *list.List
+
+	// now is used to get the current time, it can be overridden in tests.
+	now func() time.Time
+}
+
+type memoryIdempotencyItem struct {
+	key       string
+	response  *CachedResponse
+	expiresAt time.Time
+}
+
+// NewMemoryIdempotencyStore returns a MemoryIdempotencyStore keeping at most
+// capacity responses for at most ttl.
+func NewMemoryIdempotencyStore(capacity int, ttl time.Duration) *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		capacity: capacity,
+		ttl:      ttl,
+		items:    map[string]*list.Element{},
+		order:    list.New(),
+		now:      time.Now,
+	}
+}
+
+// Get implements IdempotencyStore.
+func (s *MemoryIdempotencyStore) Get(key string) (*CachedResponse, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	element, ok := s.items[key]
+	if !ok {
+		return nil, false, nil
+	}
+
+	item := element.Value.(*memoryIdempotencyItem)
+	if !s.now().Before(item.expiresAt) {
+		s.order.Remove(element)
+		delete(s.items, key)
+
+		return nil, false, nil
+	}
+
+	s.order.MoveToFront(element)
+
+	return item.response, true, nil
+}
+
+// Set implements IdempotencyStore.
+func (s *MemoryIdempotencyStore) Set(key string, response *CachedResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item := &memoryIdempotencyItem{
+		key:       key,
+		response:  response,
+		expiresAt: s.now().Add(s.ttl),
+	}
+
+	if element, ok := s.items[key]; ok {
+		element.Value = item
+		s.order.MoveToFront(element)
+
+		return nil
+	}
+
+	s.items[key] = s.order.PushFront(item)
+
+	for s.capacity > 0 && s.order.Len() > s.capacity {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.items, oldest.Value.(*memoryIdempotencyItem).key)
+	}
+
+	return nil
+}
+
+// Len returns the number of responses stored, including expired responses
+// not yet evicted.
+func (s *MemoryIdempotencyStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.order.Len()
+}
+
+// FileIdempotencyStore is an IdempotencyStore keeping each response as a
+// JSON file in a directory so that the responses survive a restart of the
+// server. Responses older than the TTL are removed when read or when calling
+// Purge. Since the responses are stored as JSON, numeric header values are
+// replayed as float64.
+type FileIdempotencyStore struct {
+	dir string
+	ttl time.Duration
+
+	// now is used to get the current time, it can be overridden in tests.
+	now func() time.Time
+}
+
+type fileIdempotencyItem struct {
+	ExpiresAt time.Time       `json:"expires_at"`
+	Response  *CachedResponse `json:"response"`
+}
+
+// NewFileIdempotencyStore returns a FileIdempotencyStore keeping responses in
+// dir for at most ttl. The directory is created if it doesn't exist.
+func NewFileIdempotencyStore(dir string, ttl time.Duration) (*FileIdempotencyStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &FileIdempotencyStore{
+		dir: dir,
+		ttl: ttl,
+		now: time.Now,
+	}, nil
+}
+
+// Get implements IdempotencyStore.
+func (s *FileIdempotencyStore) Get(key string) (*CachedResponse, bool, error) {
+	path := s.path(key)
+
+	item, err := readFileIdempotencyItem(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !s.now().Before(item.ExpiresAt) {
+		return nil, false, removeIfExists(path)
+	}
+
+	return item.Response, true, nil
+}
+
+// Set implements IdempotencyStore. The file is written to a temporary file
+// first and then renamed so a response is never partially written.
+func (s *FileIdempotencyStore) Set(key string, response *CachedResponse) error {
+	data, err := json.Marshal(fileIdempotencyItem{
+		ExpiresAt: s.now().Add(s.ttl),
+		Response:  response,
+	})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(s.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path(key))
+}
+
+// Purge will remove all expired responses.
+func (s *FileIdempotencyStore) Purge() error {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		item, err := readFileIdempotencyItem(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if s.now().Before(item.ExpiresAt) {
+			continue
+		}
+
+		if err := removeIfExists(path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// path returns the file used for key. The key is hashed since it might
+// contain characters not allowed in file names.
+func (s *FileIdempotencyStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func readFileIdempotencyItem(path string) (*fileIdempotencyItem, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	item := &fileIdempotencyItem{}
+	if err := json.Unmarshal(data, item); err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
+
+func removeIfExists(path string) error {
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,236 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+
+	amqprpc "github.com/cuiweiqiang/amqp-rpc"
+)
+
+func TestIdempotency(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		calls = 0
+	)
+
+	handler := Idempotency(IdempotencySettings{
+		Store: NewMemoryIdempotencyStore(10, time.Minute),
+	})(func(ctx context.Context, rw *amqprpc.ResponseWriter, d amqp.Delivery) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+
+		rw.WriteHeader("some-header", "handled")
+		rw.Publishing().ContentType = amqprpc.ContentTypeJSON
+		fmt.Fprintf(rw, "Got message: %s", d.Body)
+	})
+
+	send := func(d amqp.Delivery) *amqp.Publishing {
+		rw := amqprpc.NewResponseWriter(&amqp.Publishing{})
+		handler(context.Background(), rw, d)
+
+		return rw.Publishing()
+	}
+
+	first := send(amqp.Delivery{MessageId: "message-1", Body: []byte("first")})
+	assert.Equal(t, 1, calls, "handler called for first delivery")
+	assert.Equal(t, []byte("Got message: first"), first.Body, "correct body")
+	assert.Nil(t, first.Headers[IdempotentReplayHeader], "first response not replayed")
+
+	replayed := send(amqp.Delivery{MessageId: "message-1", Body: []byte("first")})
+	assert.Equal(t, 1, calls, "handler not called for redelivery")
+	assert.Equal(t, []byte("Got message: first"), replayed.Body, "stored body replayed")
+	assert.Equal(t, amqprpc.ContentTypeJSON, replayed.ContentType, "stored content type replayed")
+	assert.Equal(t, "handled", replayed.Headers["some-header"], "stored headers replayed")
+	assert.Equal(t, true, replayed.Headers[IdempotentReplayHeader], "replay is marked")
+
+	send(amqp.Delivery{
+		MessageId: "message-2",
+		Headers:   amqp.Table{IdempotencyKeyHeader: "message-1"},
+	})
+	assert.Equal(t, 1, calls, "idempotency header is used before message ID")
+
+	send(amqp.Delivery{})
+	send(amqp.Delivery{})
+	assert.Equal(t, 3, calls, "requests without key always handled")
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			send(amqp.Delivery{MessageId: "concurrent"})
+		}()
+	}
+
+	wg.Wait()
+	assert.Equal(t, 4, calls, "concurrent requests with same key handled once")
+}
+
+func TestIdempotencyRetryableError(t *testing.T) {
+	calls := 0
+
+	handler := Idempotency(IdempotencySettings{})(func(ctx context.Context, rw *amqprpc.ResponseWriter, d amqp.Delivery) {
+		calls++
+
+		rw.WriteError(&amqprpc.RemoteError{Code: amqprpc.CodeUnavailable, Message: "try again", Retryable: true})
+	})
+
+	for i := 0; i < 2; i++ {
+		handler(context.Background(), amqprpc.NewResponseWriter(&amqp.Publishing{}), amqp.Delivery{MessageId: "message-1"})
+	}
+
+	assert.Equal(t, 2, calls, "retryable errors are not stored")
+}
+
+type fakeAcknowledger struct{}
+
+func (fakeAcknowledger) Ack(tag uint64, multiple bool) error                { return nil }
+func (fakeAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error { return nil }
+func (fakeAcknowledger) Reject(tag uint64, requeue bool) error              { return nil }
+
+func TestIdempotencyNacked(t *testing.T) {
+	calls := 0
+
+	handler := Idempotency(IdempotencySettings{})(func(ctx context.Context, rw *amqprpc.ResponseWriter, d amqp.Delivery) {
+		calls++
+
+		fmt.Fprint(rw, "not done")
+		_ = d.Nack(false, true)
+	})
+
+	for i := 0; i < 2; i++ {
+		handler(context.Background(), amqprpc.NewResponseWriter(&amqp.Publishing{}), amqp.Delivery{
+			MessageId:    "message-1",
+			Acknowledger: fakeAcknowledger{},
+		})
+	}
+
+	assert.Equal(t, 2, calls, "responses for nacked deliveries are not stored")
+}
+
+func TestIdempotencyWaitContextDone(t *testing.T) {
+	started := make(chan struct{})
+	finish := make(chan struct{})
+
+	handler := Idempotency(IdempotencySettings{})(func(ctx context.Context, rw *amqprpc.ResponseWriter, d amqp.Delivery) {
+		close(started)
+		<-finish
+	})
+
+	go handler(context.Background(), amqprpc.NewResponseWriter(&amqp.Publishing{}), amqp.Delivery{MessageId: "message-1"})
+	defer close(finish)
+
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	rw := amqprpc.NewResponseWriter(&amqp.Publishing{})
+
+	done := make(chan struct{})
+	go func() {
+		handler(ctx, rw, amqp.Delivery{MessageId: "message-1"})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("still waiting for request with same key when context is done")
+	}
+
+	remoteErr := amqprpc.ParseRemoteError(&amqp.Delivery{
+		Headers: rw.Publishing().Headers,
+		Body:    rw.Publishing().Body,
+	})
+	if assert.NotNil(t, remoteErr, "error written") {
+		assert.Equal(t, amqprpc.CodeDeadlineExceeded, remoteErr.Code, "deadline exceeded")
+		assert.True(t, remoteErr.Retryable, "error is retryable")
+	}
+}
+
+func TestMemoryIdempotencyStore(t *testing.T) {
+	now := time.Now()
+
+	s := NewMemoryIdempotencyStore(2, time.Minute)
+	s.now = func() time.Time { return now }
+
+	assert.Nil(t, s.Set("a", &CachedResponse{Body: []byte("a")}), "no error storing")
+	assert.Nil(t, s.Set("b", &CachedResponse{Body: []byte("b")}), "no error storing")
+
+	// Use a so b is the least recently used.
+	_, ok, _ := s.Get("a")
+	assert.True(t, ok, "a is stored")
+
+	assert.Nil(t, s.Set("c", &CachedResponse{Body: []byte("c")}), "no error storing")
+	assert.Equal(t, 2, s.Len(), "capacity is respected")
+
+	_, ok, _ = s.Get("b")
+	assert.False(t, ok, "least recently used is evicted")
+
+	response, ok, _ := s.Get("c")
+	assert.True(t, ok, "c is stored")
+	assert.Equal(t, []byte("c"), response.Body, "correct response")
+
+	now = now.Add(time.Minute)
+
+	_, ok, _ = s.Get("c")
+	assert.False(t, ok, "expired responses not returned")
+	assert.Equal(t, 1, s.Len(), "expired response is evicted")
+}
+
+func TestFileIdempotencyStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "idempotency")
+	if !assert.Nil(t, err, "no error creating temp dir") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+
+	s, err := NewFileIdempotencyStore(dir, time.Minute)
+	assert.Nil(t, err, "no error creating store")
+	s.now = func() time.Time { return now }
+
+	_, ok, err := s.Get("a/../b")
+	assert.False(t, ok, "nothing stored")
+	assert.Nil(t, err, "no error when nothing stored")
+
+	err = s.Set("a/../b", &CachedResponse{
+		Headers:     amqp.Table{"some-header": "value"},
+		ContentType: amqprpc.ContentTypeJSON,
+		Body:        []byte("a"),
+	})
+	assert.Nil(t, err, "no error storing")
+
+	// A new store using the same directory should find the response.
+	reopened, err := NewFileIdempotencyStore(dir, time.Minute)
+	assert.Nil(t, err, "no error reopening store")
+	reopened.now = s.now
+
+	response, ok, err := reopened.Get("a/../b")
+	assert.Nil(t, err, "no error reading")
+	assert.True(t, ok, "response is stored")
+	assert.Equal(t, []byte("a"), response.Body, "correct body")
+	assert.Equal(t, amqprpc.ContentTypeJSON, response.ContentType, "correct content type")
+	assert.Equal(t, "value", response.Headers["some-header"], "correct headers")
+
+	assert.Nil(t, s.Set("b", &CachedResponse{Body: []byte("b")}), "no error storing")
+
+	now = now.Add(time.Minute)
+
+	assert.Nil(t, s.Purge(), "no error purging")
+
+	files, _ := ioutil.ReadDir(dir)
+	assert.Equal(t, 0, len(files), "expired responses purged")
+}
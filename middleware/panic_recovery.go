@@ -37,10 +37,13 @@ func PanicRecovery(next amqprpc.HandlerFunc) amqprpc.HandlerFunc {
 				}
 
 				rw.WriteHeader(HandlerCrashedHeader, crashMessage)
-				fmt.Fprintf(rw, "crashed when running handler: %s", crashMessage)
+				rw.WriteError(amqprpc.NewRemoteError(
+					amqprpc.CodeInternal,
+					fmt.Sprintf("crashed when running handler: %s", crashMessage),
+				))
 
-				// Nack message, do not requeue
-				if err := d.Nack(true, false); err != nil {
+				// Nack only this message, do not requeue
+				if err := d.Nack(false, false); err != nil {
 					log.Printf("could not nack message: %s", err.Error())
 				}
 			}
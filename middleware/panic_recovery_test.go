@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"context"
+	"testing"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+
+	amqprpc "github.com/cuiweiqiang/amqp-rpc"
+)
+
+type nackRecorder struct {
+	fakeAcknowledger
+	multiple *bool
+	requeue  *bool
+}
+
+func (n nackRecorder) Nack(tag uint64, multiple bool, requeue bool) error {
+	*n.multiple = multiple
+	*n.requeue = requeue
+
+	return nil
+}
+
+func TestPanicRecovery(t *testing.T) {
+	var (
+		multiple = true
+		requeue  = true
+		rw       = amqprpc.NewResponseWriter(&amqp.Publishing{})
+	)
+
+	handler := PanicRecovery(func(ctx context.Context, rw *amqprpc.ResponseWriter, d amqp.Delivery) {
+		panic("something broke")
+	})
+
+	handler(context.Background(), rw, amqp.Delivery{
+		Acknowledger: nackRecorder{multiple: &multiple, requeue: &requeue},
+	})
+
+	assert.False(t, multiple, "only the delivery of the handler is nacked")
+	assert.False(t, requeue, "delivery is not requeued")
+	assert.Equal(t, "something broke", rw.Publishing().Headers[HandlerCrashedHeader], "crash header set")
+
+	remoteErr := amqprpc.ParseRemoteError(&amqp.Delivery{
+		Headers: rw.Publishing().Headers,
+		Body:    rw.Publishing().Body,
+	})
+	if assert.NotNil(t, remoteErr, "error written") {
+		assert.Equal(t, amqprpc.CodeInternal, remoteErr.Code, "internal error")
+	}
+}
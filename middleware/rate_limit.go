@@ -0,0 +1,243 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	amqprpc "github.com/cuiweiqiang/amqp-rpc"
+)
+
+// ErrTooManyRequests is returned by the RateLimit middleware when FailFast is
+// set and a request would exceed the rate limit or the maximum number of
+// requests in flight.
+var ErrTooManyRequests = errors.New("too many requests")
+
+// RateLimitSettings is the configuration used by the RateLimit middleware. A
+// zero value disables the corresponding limit.
+type RateLimitSettings struct {
+	// Rate is the number of requests per second allowed in total and Burst is
+	// the number of requests allowed at once. Burst defaults to 1.
+	Rate  float64
+	Burst int
+
+	// RoutingKeyRate and RoutingKeyBurst is the same as Rate and Burst but
+	// for each routing key.
+	RoutingKeyRate  float64
+	RoutingKeyBurst int
+
+	// MaxInFlight is the maximum number of requests sent but not yet
+	// finished.
+	MaxInFlight int
+
+	// FailFast will make requests exceeding a limit fail with
+	// ErrTooManyRequests instead of waiting until they're allowed.
+	FailFast bool
+}
+
+// tokenBucket is a token bucket refilled with rate tokens per second holding
+// at most burst tokens.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	mu     sync.Mutex
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst <= 0 {
+		burst = 1
+	}
+
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// reserve will take a token from the bucket and return how long to wait
+// before it may be used. If wait is false and no token is available right
+// away, no token is taken and false is returned.
+func (b *tokenBucket) reserve(wait bool) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+
+	if !wait {
+		return 0, false
+	}
+
+	// Take the token in advance, the bucket will be negative until it's
+	// refilled.
+	missing := 1 - b.tokens
+	b.tokens--
+
+	return time.Duration(missing / b.rate * float64(time.Second)), true
+}
+
+// cancel will give back a token reserved but never used.
+func (b *tokenBucket) cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens++
+}
+
+type rateLimiter struct {
+	settings   RateLimitSettings
+	bucket     *tokenBucket
+	keyBuckets map[string]*tokenBucket
+	inFlight   chan struct{}
+	mu         sync.Mutex
+}
+
+/*
+RateLimit returns a client middleware which limits the rate of requests, both
+in total and for each routing key, and the number of requests in flight. By
+default a request exceeding a limit will wait until it's allowed or the request
+context is done, set FailFast to return ErrTooManyRequests instead.
+
+	c := NewClient(url).AddMiddleware(
+		middleware.RateLimit(middleware.RateLimitSettings{
+			Rate:        100,
+			Burst:       10,
+			MaxInFlight: 50,
+		}),
+	)
+*/
+func RateLimit(s RateLimitSettings) amqprpc.ClientMiddlewareFunc {
+	rl := &rateLimiter{
+		settings:   s,
+		keyBuckets: map[string]*tokenBucket{},
+	}
+
+	if s.Rate > 0 {
+		rl.bucket = newTokenBucket(s.Rate, s.Burst)
+	}
+
+	if s.MaxInFlight > 0 {
+		rl.inFlight = make(chan struct{}, s.MaxInFlight)
+	}
+
+	return func(next amqprpc.SendFunc) amqprpc.SendFunc {
+		return func(r *amqprpc.Request) (*amqp.Delivery, error) {
+			ctx := r.Context
+			if ctx == nil {
+				ctx = context.Background()
+			}
+
+			if err := rl.acquireInFlight(ctx); err != nil {
+				return nil, err
+			}
+
+			defer rl.releaseInFlight()
+
+			if err := rl.wait(ctx, rl.bucket); err != nil {
+				return nil, err
+			}
+
+			if err := rl.wait(ctx, rl.keyBucket(r.RoutingKey)); err != nil {
+				// The request is never sent, give back the token so one busy
+				// routing key doesn't use up the limit for all the others.
+				if rl.bucket != nil {
+					rl.bucket.cancel()
+				}
+
+				return nil, err
+			}
+
+			return next(r)
+		}
+	}
+}
+
+func (rl *rateLimiter) keyBucket(routingKey string) *tokenBucket {
+	if rl.settings.RoutingKeyRate <= 0 {
+		return nil
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	b, ok := rl.keyBuckets[routingKey]
+	if !ok {
+		b = newTokenBucket(rl.settings.RoutingKeyRate, rl.settings.RoutingKeyBurst)
+		rl.keyBuckets[routingKey] = b
+	}
+
+	return b
+}
+
+// wait will take a token from b, waiting until it's available unless
+// FailFast is set. A nil bucket means no limit.
+func (rl *rateLimiter) wait(ctx context.Context, b *tokenBucket) error {
+	if b == nil {
+		return nil
+	}
+
+	delay, ok := b.reserve(!rl.settings.FailFast)
+	if !ok {
+		return ErrTooManyRequests
+	}
+
+	if delay == 0 {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		b.cancel()
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+func (rl *rateLimiter) acquireInFlight(ctx context.Context) error {
+	if rl.inFlight == nil {
+		return nil
+	}
+
+	if rl.settings.FailFast {
+		select {
+		case rl.inFlight <- struct{}{}:
+			return nil
+		default:
+			return ErrTooManyRequests
+		}
+	}
+
+	select {
+	case rl.inFlight <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (rl *rateLimiter) releaseInFlight() {
+	if rl.inFlight == nil {
+		return
+	}
+
+	<-rl.inFlight
+}
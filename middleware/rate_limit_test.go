@@ -0,0 +1,122 @@
+package middleware
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+
+	amqprpc "github.com/cuiweiqiang/amqp-rpc"
+)
+
+func okSender(r *amqprpc.Request) (*amqp.Delivery, error) {
+	return &amqp.Delivery{}, nil
+}
+
+func TestRateLimitFailFast(t *testing.T) {
+	send := RateLimit(RateLimitSettings{
+		Rate:     10,
+		Burst:    2,
+		FailFast: true,
+	})(okSender)
+
+	for i := 0; i < 2; i++ {
+		_, err := send(amqprpc.NewRequest())
+		assert.Nil(t, err, "requests within burst allowed")
+	}
+
+	_, err := send(amqprpc.NewRequest())
+	assert.Equal(t, ErrTooManyRequests, err, "request exceeding burst fails")
+
+	time.Sleep(150 * time.Millisecond)
+
+	_, err = send(amqprpc.NewRequest())
+	assert.Nil(t, err, "request allowed after refill")
+}
+
+func TestRateLimitRoutingKeyRefund(t *testing.T) {
+	send := RateLimit(RateLimitSettings{
+		Rate:            0.01,
+		Burst:           3,
+		RoutingKeyRate:  0.01,
+		RoutingKeyBurst: 1,
+		FailFast:        true,
+	})(okSender)
+
+	_, err := send(amqprpc.NewRequest().WithRoutingKey("hot"))
+	assert.Nil(t, err, "first request to hot key allowed")
+
+	for i := 0; i < 5; i++ {
+		_, err = send(amqprpc.NewRequest().WithRoutingKey("hot"))
+		assert.Equal(t, ErrTooManyRequests, err, "hot key limited")
+	}
+
+	for _, rk := range []string{"a", "b"} {
+		_, err = send(amqprpc.NewRequest().WithRoutingKey(rk))
+		assert.Nil(t, err, "other keys not limited by the hot key")
+	}
+}
+
+func TestRateLimitBlocking(t *testing.T) {
+	send := RateLimit(RateLimitSettings{
+		RoutingKeyRate: 20,
+	})(okSender)
+
+	start := time.Now()
+
+	for i := 0; i < 3; i++ {
+		_, err := send(amqprpc.NewRequest().WithRoutingKey("limited"))
+		assert.Nil(t, err, "blocking request allowed")
+	}
+
+	assert.True(t, time.Since(start) >= 90*time.Millisecond, "requests waited for tokens")
+
+	start = time.Now()
+
+	_, err := send(amqprpc.NewRequest().WithRoutingKey("other"))
+	assert.Nil(t, err, "other routing key allowed")
+	assert.True(t, time.Since(start) < 40*time.Millisecond, "other routing key has own bucket")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = send(amqprpc.NewRequest().WithRoutingKey("limited").WithContext(ctx))
+	assert.Equal(t, context.Canceled, err, "context done while waiting")
+}
+
+func TestRateLimitMaxInFlight(t *testing.T) {
+	var (
+		release = make(chan struct{})
+		started = make(chan struct{})
+		wg      sync.WaitGroup
+	)
+
+	send := RateLimit(RateLimitSettings{
+		MaxInFlight: 1,
+		FailFast:    true,
+	})(func(r *amqprpc.Request) (*amqp.Delivery, error) {
+		close(started)
+		<-release
+
+		return &amqp.Delivery{}, nil
+	})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		_, err := send(amqprpc.NewRequest())
+		assert.Nil(t, err, "first request allowed")
+	}()
+
+	<-started
+
+	_, err := send(amqprpc.NewRequest())
+	assert.Equal(t, ErrTooManyRequests, err, "too many requests in flight")
+
+	close(release)
+	wg.Wait()
+}
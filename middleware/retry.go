@@ -0,0 +1,152 @@
+package middleware
+
+import (
+	"context"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/streadway/amqp"
+
+	amqprpc "github.com/cuiweiqiang/amqp-rpc"
+)
+
+const (
+	// IdempotencyKeyHeader is the header holding a key which is the same for
+	// every attempt of a request. Servers can use it to deduplicate requests.
+	IdempotencyKeyHeader = "X-Idempotency-Key"
+)
+
+// RetryPolicy is the configuration used by the Retry middleware.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times the request is sent,
+	// including the first attempt.
+	MaxAttempts int
+
+	// Backoff is used to decide how long to wait before each retry. The first
+	// retry is attempt 1. If nil, the request is retried directly.
+	Backoff amqprpc.BackoffStrategy
+
+	// Retryable tells if a request failing with the given error should be
+	// retried. If nil, DefaultRetryable is used.
+	Retryable func(error) bool
+}
+
+// DefaultRetryable will retry requests that timed out, that were nacked by
+// the broker, that couldn't be published because of an amqp error which isn't
+// permanent or that failed with a *amqprpc.RemoteError marked as retryable.
+func DefaultRetryable(err error) bool {
+	switch e := err.(type) {
+	case *amqp.Error:
+		return !isPermanentAMQPError(e)
+	case *amqprpc.RemoteError:
+		return e.Retryable
+	}
+
+	return err == amqprpc.ErrTimeout || err == amqprpc.ErrPublishNacked
+}
+
+// isPermanentAMQPError tells if err is caused by something that won't change
+// by trying again, i.e. missing permissions or a missing exchange.
+func isPermanentAMQPError(err *amqp.Error) bool {
+	switch err.Code {
+	case amqp.ContentTooLarge,
+		amqp.InvalidPath,
+		amqp.AccessRefused,
+		amqp.NotFound,
+		amqp.ResourceLocked,
+		amqp.PreconditionFailed,
+		amqp.FrameError,
+		amqp.SyntaxError,
+		amqp.CommandInvalid,
+		amqp.NotAllowed,
+		amqp.NotImplemented:
+		return true
+	}
+
+	return false
+}
+
+/*
+Retry returns a client middleware which will resend a request failing with a
+retryable error according to the RetryPolicy. Every attempt is sent with the
+same IdempotencyKeyHeader so that servers can deduplicate the requests. If the
+header is already set it's kept, otherwise the message ID of the publishing is
+used, or a new unique key is generated.
+
+	c := NewClient(url).AddMiddleware(
+		middleware.Retry(middleware.RetryPolicy{
+			MaxAttempts: 3,
+			Backoff:     amqprpc.ExponentialBackoff(100*time.Millisecond, time.Second),
+		}),
+	)
+
+Each attempt is sent with a new correlation ID, unless one was set before the
+request was sent, so that a late reply or return for an earlier attempt is
+never mistaken for one to the current attempt. No more attempts will be made
+if the request context is done.
+*/
+func Retry(p RetryPolicy) amqprpc.ClientMiddlewareFunc {
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = DefaultRetryable
+	}
+
+	return func(next amqprpc.SendFunc) amqprpc.SendFunc {
+		return func(r *amqprpc.Request) (*amqp.Delivery, error) {
+			stampIdempotencyKey(r)
+
+			var (
+				d   *amqp.Delivery
+				err error
+
+				// keepCorrelationID is true if the correlation ID is set
+				// by the caller and not generated by the client.
+				keepCorrelationID = r.Publishing.CorrelationId != ""
+			)
+
+			for attempt := 1; ; attempt++ {
+				if !keepCorrelationID {
+					r.Publishing.CorrelationId = ""
+				}
+
+				d, err = next(r)
+				if err == nil || !retryable(err) || attempt >= p.MaxAttempts {
+					return d, err
+				}
+
+				var backoff time.Duration
+				if p.Backoff != nil {
+					backoff = p.Backoff(attempt)
+				}
+
+				ctx := r.Context
+				if ctx == nil {
+					ctx = context.Background()
+				}
+
+				select {
+				case <-ctx.Done():
+					return d, err
+				case <-time.After(backoff):
+				}
+			}
+		}
+	}
+}
+
+func stampIdempotencyKey(r *amqprpc.Request) {
+	if r.Publishing.Headers == nil {
+		r.Publishing.Headers = amqp.Table{}
+	}
+
+	if _, ok := r.Publishing.Headers[IdempotencyKeyHeader]; ok {
+		return
+	}
+
+	key := r.Publishing.MessageId
+	if key == "" {
+		key = uuid.Must(uuid.NewV4(), nil).String()
+	}
+
+	r.WriteHeader(IdempotencyKeyHeader, key)
+}
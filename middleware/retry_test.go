@@ -0,0 +1,166 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+
+	amqprpc "github.com/cuiweiqiang/amqp-rpc"
+)
+
+func TestRetry(t *testing.T) {
+	cases := []struct {
+		description      string
+		errs             []error
+		policy           RetryPolicy
+		expectedAttempts int
+		expectedErr      error
+	}{
+		{
+			description:      "retry until success",
+			errs:             []error{amqprpc.ErrTimeout, amqprpc.ErrTimeout, nil},
+			policy:           RetryPolicy{MaxAttempts: 5},
+			expectedAttempts: 3,
+			expectedErr:      nil,
+		},
+		{
+			description:      "give up after max attempts",
+			errs:             []error{amqprpc.ErrTimeout, amqp.ErrClosed, amqprpc.ErrPublishNacked, nil},
+			policy:           RetryPolicy{MaxAttempts: 3},
+			expectedAttempts: 3,
+			expectedErr:      amqprpc.ErrPublishNacked,
+		},
+		{
+			description: "retry remote errors marked as retryable",
+			errs: []error{
+				&amqprpc.RemoteError{Code: amqprpc.CodeUnavailable, Retryable: true},
+				amqprpc.NewRemoteError(amqprpc.CodeNotFound, "not found"),
+			},
+			policy:           RetryPolicy{MaxAttempts: 3},
+			expectedAttempts: 2,
+			expectedErr:      amqprpc.NewRemoteError(amqprpc.CodeNotFound, "not found"),
+		},
+		{
+			description:      "don't retry errors that aren't retryable",
+			errs:             []error{errors.New("not retryable"), nil},
+			policy:           RetryPolicy{MaxAttempts: 3},
+			expectedAttempts: 1,
+			expectedErr:      errors.New("not retryable"),
+		},
+		{
+			description: "custom retryable and backoff",
+			errs:        []error{errors.New("retry me"), nil},
+			policy: RetryPolicy{
+				MaxAttempts: 3,
+				Backoff:     amqprpc.ConstantBackoff(time.Millisecond),
+				Retryable: func(err error) bool {
+					return err.Error() == "retry me"
+				},
+			},
+			expectedAttempts: 2,
+			expectedErr:      nil,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.description, func(t *testing.T) {
+			var (
+				attempts int
+				keys     = map[interface{}]struct{}{}
+			)
+
+			send := Retry(tc.policy)(func(r *amqprpc.Request) (*amqp.Delivery, error) {
+				keys[r.Publishing.Headers[IdempotencyKeyHeader]] = struct{}{}
+				err := tc.errs[attempts]
+				attempts++
+
+				return &amqp.Delivery{}, err
+			})
+
+			_, err := send(amqprpc.NewRequest())
+
+			assert.Equal(t, tc.expectedErr, err, "correct error returned")
+			assert.Equal(t, tc.expectedAttempts, attempts, "correct number of attempts")
+			assert.Equal(t, 1, len(keys), "same idempotency key for all attempts")
+		})
+	}
+}
+
+func TestRetryIdempotencyKey(t *testing.T) {
+	var key interface{}
+
+	send := Retry(RetryPolicy{MaxAttempts: 1})(func(r *amqprpc.Request) (*amqp.Delivery, error) {
+		key = r.Publishing.Headers[IdempotencyKeyHeader]
+
+		return &amqp.Delivery{}, nil
+	})
+
+	r := amqprpc.NewRequest()
+	r.Publishing.MessageId = "message-id"
+
+	_, _ = send(r)
+	assert.Equal(t, "message-id", key, "message ID used as idempotency key")
+
+	r = amqprpc.NewRequest()
+	r.WriteHeader(IdempotencyKeyHeader, "my-key")
+
+	_, _ = send(r)
+	assert.Equal(t, "my-key", key, "existing idempotency key kept")
+}
+
+func TestRetryCorrelationID(t *testing.T) {
+	ids := []string{}
+
+	send := Retry(RetryPolicy{MaxAttempts: 3})(func(r *amqprpc.Request) (*amqp.Delivery, error) {
+		if r.Publishing.CorrelationId == "" {
+			r.Publishing.CorrelationId = fmt.Sprintf("generated-%d", len(ids))
+		}
+
+		ids = append(ids, r.Publishing.CorrelationId)
+
+		return nil, amqprpc.ErrTimeout
+	})
+
+	_, _ = send(amqprpc.NewRequest())
+	assert.Equal(t, []string{"generated-0", "generated-1", "generated-2"}, ids, "new correlation ID for each attempt")
+
+	ids = []string{}
+
+	_, _ = send(amqprpc.NewRequest().WithCorrelationID("my-id"))
+	assert.Equal(t, []string{"my-id", "my-id", "my-id"}, ids, "correlation ID set by caller kept")
+}
+
+func TestDefaultRetryable(t *testing.T) {
+	assert.True(t, DefaultRetryable(amqp.ErrClosed), "closed channel is retried")
+	assert.True(t, DefaultRetryable(&amqp.Error{Code: amqp.ConnectionForced}), "forced close is retried")
+	assert.False(t, DefaultRetryable(&amqp.Error{Code: amqp.AccessRefused}), "access refused isn't retried")
+	assert.False(t, DefaultRetryable(&amqp.Error{Code: amqp.NotFound}), "not found isn't retried")
+	assert.True(t, DefaultRetryable(amqprpc.ErrTimeout), "timeout is retried")
+	assert.False(t, DefaultRetryable(errors.New("other")), "other errors aren't retried")
+}
+
+func TestRetryContextDone(t *testing.T) {
+	var attempts int
+
+	send := Retry(RetryPolicy{
+		MaxAttempts: 10,
+		Backoff:     amqprpc.ConstantBackoff(time.Hour),
+	})(func(r *amqprpc.Request) (*amqp.Delivery, error) {
+		attempts++
+
+		return nil, amqprpc.ErrTimeout
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := send(amqprpc.NewRequest().WithContext(ctx))
+
+	assert.Equal(t, amqprpc.ErrTimeout, err, "last error returned")
+	assert.Equal(t, 1, attempts, "no retries after context is done")
+}
@@ -0,0 +1,138 @@
+package amqprpc
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/streadway/amqp"
+)
+
+// Code is a status code telling why a handler failed. The codes are the same
+// as the ones used by gRPC.
+type Code int
+
+// The status codes that can be used with RemoteError.
+const (
+	CodeOK Code = iota
+	CodeCanceled
+	CodeUnknown
+	CodeInvalidArgument
+	CodeDeadlineExceeded
+	CodeNotFound
+	CodeAlreadyExists
+	CodePermissionDenied
+	CodeResourceExhausted
+	CodeFailedPrecondition
+	CodeAborted
+	CodeOutOfRange
+	CodeUnimplemented
+	CodeInternal
+	CodeUnavailable
+	CodeDataLoss
+	CodeUnauthenticated
+)
+
+var codeNames = map[Code]string{
+	CodeOK:                 "OK",
+	CodeCanceled:           "CANCELED",
+	CodeUnknown:            "UNKNOWN",
+	CodeInvalidArgument:    "INVALID_ARGUMENT",
+	CodeDeadlineExceeded:   "DEADLINE_EXCEEDED",
+	CodeNotFound:           "NOT_FOUND",
+	CodeAlreadyExists:      "ALREADY_EXISTS",
+	CodePermissionDenied:   "PERMISSION_DENIED",
+	CodeResourceExhausted:  "RESOURCE_EXHAUSTED",
+	CodeFailedPrecondition: "FAILED_PRECONDITION",
+	CodeAborted:            "ABORTED",
+	CodeOutOfRange:         "OUT_OF_RANGE",
+	CodeUnimplemented:      "UNIMPLEMENTED",
+	CodeInternal:           "INTERNAL",
+	CodeUnavailable:        "UNAVAILABLE",
+	CodeDataLoss:           "DATA_LOSS",
+	CodeUnauthenticated:    "UNAUTHENTICATED",
+}
+
+// String implements the fmt.Stringer interface.
+func (c Code) String() string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("CODE(%d)", int(c))
+}
+
+// RemoteError is the error written by a handler with
+// ResponseWriter.WriteError. The client will return it as the error from Send
+// when it's received.
+type RemoteError struct {
+	Code      Code                   `json:"code"`
+	Message   string                 `json:"message"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	Retryable bool                   `json:"retryable"`
+}
+
+// NewRemoteError returns a *RemoteError with the code and message.
+func NewRemoteError(code Code, message string) *RemoteError {
+	return &RemoteError{
+		Code:    code,
+		Message: message,
+	}
+}
+
+// Error implements the error interface.
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("remote error: %s: %s", e.Code, e.Message)
+}
+
+/*
+WriteError will write err as the response. The error is written as a JSON
+envelope holding the code, message, details and retryable flag of the error
+and the ErrorHeader is set to the message. If err isn't a *RemoteError it will
+be written with CodeUnknown.
+
+	if user == nil {
+		rw.WriteError(NewRemoteError(CodeNotFound, "no such user"))
+		return
+	}
+*/
+func (rw *ResponseWriter) WriteError(err error) {
+	remoteErr, ok := err.(*RemoteError)
+	if !ok {
+		remoteErr = NewRemoteError(CodeUnknown, err.Error())
+	}
+
+	body, marshalErr := json.Marshal(remoteErr)
+	if marshalErr != nil {
+		// The details couldn't be encoded, send the error without them.
+		body, _ = json.Marshal(&RemoteError{
+			Code:      remoteErr.Code,
+			Message:   remoteErr.Message,
+			Retryable: remoteErr.Retryable,
+		})
+	}
+
+	rw.publishing.ContentType = ContentTypeJSON
+	rw.publishing.Body = body
+	rw.WriteHeader(ErrorHeader, remoteErr.Message)
+}
+
+// ParseRemoteError returns the *RemoteError in the delivery if it has the
+// ErrorHeader set, otherwise nil. If the body isn't an error envelope the
+// error will have CodeUnknown and the header as message.
+func ParseRemoteError(d *amqp.Delivery) *RemoteError {
+	if d == nil {
+		return nil
+	}
+
+	message, ok := d.Headers[ErrorHeader].(string)
+	if !ok {
+		return nil
+	}
+
+	remoteErr := RemoteError{}
+	if err := json.Unmarshal(d.Body, &remoteErr); err != nil || remoteErr.Code == CodeOK {
+		return NewRemoteError(CodeUnknown, message)
+	}
+
+	return &remoteErr
+}
@@ -0,0 +1,67 @@
+package amqprpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoteError(t *testing.T) {
+	var (
+		assert = assert.New(t)
+		rw     = &ResponseWriter{publishing: &amqp.Publishing{}}
+	)
+
+	rw.WriteError(&RemoteError{
+		Code:      CodeUnavailable,
+		Message:   "try again later",
+		Details:   map[string]interface{}{"shard": "a"},
+		Retryable: true,
+	})
+
+	assert.Equal(ContentTypeJSON, rw.Publishing().ContentType, "error envelope is JSON")
+	assert.Equal("try again later", rw.Publishing().Headers[ErrorHeader], "error header set")
+
+	remoteErr := ParseRemoteError(&amqp.Delivery{
+		Headers: rw.Publishing().Headers,
+		Body:    rw.Publishing().Body,
+	})
+
+	assert.Equal(CodeUnavailable, remoteErr.Code, "code parsed")
+	assert.Equal("try again later", remoteErr.Message, "message parsed")
+	assert.Equal(map[string]interface{}{"shard": "a"}, remoteErr.Details, "details parsed")
+	assert.True(remoteErr.Retryable, "retryable parsed")
+	assert.Equal("remote error: UNAVAILABLE: try again later", remoteErr.Error(), "error message")
+
+	rw = &ResponseWriter{publishing: &amqp.Publishing{}}
+	rw.WriteError(errors.New("plain error"))
+
+	remoteErr = ParseRemoteError(&amqp.Delivery{
+		Headers: rw.Publishing().Headers,
+		Body:    rw.Publishing().Body,
+	})
+
+	assert.Equal(NewRemoteError(CodeUnknown, "plain error"), remoteErr, "plain errors written as unknown")
+
+	assert.Nil(ParseRemoteError(&amqp.Delivery{}), "no error without header")
+	assert.Equal("CODE(100)", Code(100).String(), "unknown codes has a name")
+}
+
+func TestClientRemoteError(t *testing.T) {
+	s := NewServer(serverTestURL, QosConfig{})
+	s.Bind(DirectBinding("remote-error", func(ctx context.Context, rw *ResponseWriter, d amqp.Delivery) {
+		rw.WriteError(NewRemoteError(CodeNotFound, "no such thing"))
+	}))
+
+	stop := startAndWait(s)
+	defer stop()
+
+	c := NewClient(serverTestURL, QosConfig{})
+
+	response, err := c.Send(NewRequest().WithRoutingKey("remote-error"))
+	assert.Nil(t, response, "no response on remote error")
+	assert.Equal(t, NewRemoteError(CodeNotFound, "no such thing"), err, "remote error returned")
+}
@@ -0,0 +1,318 @@
+package amqprpc
+
+import (
+	"context"
+
+	"github.com/streadway/amqp"
+)
+
+// ReplaySettings is the settings used by Replayer.Replay().
+type ReplaySettings struct {
+	// Filter decides which messages to replay. If nil, all messages are
+	// replayed. Messages not replayed are left in the dead letter queue.
+	Filter func(d amqp.Delivery) bool
+
+	// Limit is the maximum number of messages to replay, 0 means no limit.
+	Limit int
+
+	// IncludeExpired makes messages dead lettered by the broker because they
+	// expired replayable. Requests get an expiration from the client timeout,
+	// so these are requests no one waited for anymore and they're skipped by
+	// default.
+	IncludeExpired bool
+}
+
+// ReplayResult tells what happened when replaying a dead letter queue.
+type ReplayResult struct {
+	// Replayed is the number of messages moved back to where they were
+	// originally published.
+	Replayed int
+
+	// Skipped is the number of messages left in the dead letter queue
+	// because they expired, because they didn't match the filter, because
+	// it's unknown where they were originally published or because they
+	// couldn't be routed there, i.e. when the original queue no longer
+	// exists.
+	Skipped int
+}
+
+/*
+Replayer moves dead lettered messages back to the exchange and routing key
+they were originally published with.
+
+	replayer := NewReplayer(url)
+
+	result, err := replayer.Replay(ctx, DeadLetterQueueName("myqueue"), ReplaySettings{
+		Filter: func(d amqp.Delivery) bool {
+			return d.Headers[FailureReasonHeader] == "database unavailable"
+		},
+		Limit: 100,
+	})
+
+Each message is published in confirm mode with the mandatory flag and only
+removed from the dead letter queue once the broker has confirmed the
+publishing, so a message is never lost but might be replayed twice if the
+replayer is interrupted. Messages returned by the broker because they couldn't
+be routed are left in the dead letter queue.
+*/
+type Replayer struct {
+	// url is the URL where the replayer should dial.
+	url string
+
+	// dialconfig is a amqp.Config which holds information about the
+	// connection such as authentication, TLS configuration and a dialer.
+	dialconfig amqp.Config
+
+	// connectionManager is used to get the channel from if set instead of
+	// creating a new connection for each replay.
+	connectionManager *ConnectionManager
+}
+
+// NewReplayer will return a pointer to a new Replayer.
+func NewReplayer(url string) *Replayer {
+	return &Replayer{
+		url: url,
+		dialconfig: amqp.Config{
+			Dial: DefaultDialer,
+		},
+	}
+}
+
+// WithDialConfig sets the dial config used for the replayer.
+func (r *Replayer) WithDialConfig(dc amqp.Config) *Replayer {
+	r.dialconfig = dc
+
+	return r
+}
+
+// WithTLS sets the TLS config in the dial config for the replayer.
+func (r *Replayer) WithTLS(cert Certificates) *Replayer {
+	r.dialconfig.TLSClientConfig = cert.TLSConfig()
+
+	return r
+}
+
+// WithConnectionManager makes the replayer use the publish connection of the
+// ConnectionManager instead of creating it's own connection.
+func (r *Replayer) WithConnectionManager(m *ConnectionManager) *Replayer {
+	r.connectionManager = m
+
+	return r
+}
+
+// OriginalDestination returns the exchange and routing key a dead lettered
+// message was originally published with. The headers set by the server are
+// used if present, otherwise the x-death header set by the broker. The bool
+// is false if the original destination is unknown.
+func OriginalDestination(d amqp.Delivery) (string, string, bool) {
+	if exchange, ok := d.Headers[OriginalExchangeHeader].(string); ok {
+		routingKey, _ := d.Headers[OriginalRoutingKeyHeader].(string)
+
+		return exchange, routingKey, true
+	}
+
+	deaths, ok := d.Headers["x-death"].([]interface{})
+	if !ok || len(deaths) == 0 {
+		return "", "", false
+	}
+
+	// The most recent death is the first one.
+	death, ok := deaths[0].(amqp.Table)
+	if !ok {
+		return "", "", false
+	}
+
+	exchange, ok := death["exchange"].(string)
+	if !ok {
+		return "", "", false
+	}
+
+	routingKeys, ok := death["routing-keys"].([]interface{})
+	if !ok || len(routingKeys) == 0 {
+		return "", "", false
+	}
+
+	routingKey, ok := routingKeys[0].(string)
+	if !ok {
+		return "", "", false
+	}
+
+	return exchange, routingKey, true
+}
+
+// ExpiredInQueue tells if the dead lettered message d was dead lettered by the
+// broker because it expired, i.e. a request which timed out while waiting in
+// the queue, rather than failed by a handler.
+func ExpiredInQueue(d amqp.Delivery) bool {
+	if _, ok := d.Headers[FailureReasonHeader]; ok {
+		return false
+	}
+
+	deaths, ok := d.Headers["x-death"].([]interface{})
+	if !ok || len(deaths) == 0 {
+		return false
+	}
+
+	// The most recent death is the first one.
+	death, ok := deaths[0].(amqp.Table)
+	if !ok {
+		return false
+	}
+
+	return death["reason"] == "expired"
+}
+
+// Replay will move the messages in the dead letter queue back to where they
+// were originally published according to the settings. Only the messages in
+// the queue when Replay is called are considered. Replay stops when ctx is
+// done and returns what was replayed so far together with ctx.Err().
+func (r *Replayer) Replay(ctx context.Context, deadLetterQueue string, settings ReplaySettings) (ReplayResult, error) {
+	result := ReplayResult{}
+
+	ch, err := r.channel()
+	if err != nil {
+		return result, err
+	}
+
+	// Closing the channel will put back all the messages we didn't replay
+	// since they're never acked.
+	defer ch.Close()
+
+	if err = ch.Confirm(false); err != nil {
+		return result, err
+	}
+
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+
+	// The broker returns a message it can't route before confirming it, so
+	// it's always in the chan when the confirmation arrives.
+	returns := ch.NotifyReturn(make(chan amqp.Return, 1))
+
+	queue, err := ch.QueueInspect(deadLetterQueue)
+	if err != nil {
+		return result, err
+	}
+
+	for i := 0; i < queue.Messages; i++ {
+		if settings.Limit > 0 && result.Replayed >= settings.Limit {
+			break
+		}
+
+		if err = ctx.Err(); err != nil {
+			return result, err
+		}
+
+		d, ok, err := ch.Get(deadLetterQueue, false)
+		if err != nil {
+			return result, err
+		}
+
+		if !ok {
+			// The queue is empty.
+			break
+		}
+
+		if !settings.IncludeExpired && ExpiredInQueue(d) {
+			result.Skipped++
+			continue
+		}
+
+		exchange, routingKey, ok := OriginalDestination(d)
+		if !ok || (settings.Filter != nil && !settings.Filter(d)) {
+			result.Skipped++
+			continue
+		}
+
+		err = ch.Publish(exchange, routingKey, true, false, replayPublishing(d))
+		if err != nil {
+			return result, err
+		}
+
+		select {
+		case confirmation, ok := <-confirms:
+			if !ok {
+				return result, ErrUnexpectedConnClosed
+			}
+
+			if !confirmation.Ack {
+				return result, ErrPublishNacked
+			}
+		case <-ctx.Done():
+			return result, ctx.Err()
+		}
+
+		select {
+		case <-returns:
+			// Not acked so it's put back in the dead letter queue when the
+			// channel is closed.
+			result.Skipped++
+			continue
+		default:
+		}
+
+		if err = d.Ack(false); err != nil {
+			return result, err
+		}
+
+		result.Replayed++
+	}
+
+	return result, nil
+}
+
+func (r *Replayer) channel() (*amqp.Channel, error) {
+	if r.connectionManager != nil {
+		return r.connectionManager.PublishChannel()
+	}
+
+	conn, err := amqp.DialConfig(r.url, r.dialconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// Close the connection when the channel is closed.
+	go func() {
+		<-ch.NotifyClose(make(chan *amqp.Error, 1))
+		conn.Close()
+	}()
+
+	return ch, nil
+}
+
+// replayPublishing returns the publishing used to replay d, without the
+// headers added when it was dead lettered. The deadline is removed too since
+// it has most likely passed, the replayed request has no deadline.
+func replayPublishing(d amqp.Delivery) amqp.Publishing {
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		switch k {
+		case FailureReasonHeader, FailureQueueHeader, FailureTimeHeader,
+			OriginalExchangeHeader, OriginalRoutingKeyHeader, DeadlineHeader, "x-death":
+			continue
+		}
+
+		headers[k] = v
+	}
+
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		UserId:          d.UserId,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	}
+}
@@ -8,6 +8,11 @@ import (
 	"github.com/streadway/amqp"
 )
 
+// ReplyStopFunc is used when gathering multiple replies for a request. It's
+// called with all replies received so far each time a new reply is received
+// and gathering will stop when it returns true.
+type ReplyStopFunc func(replies []*amqp.Delivery) bool
+
 // Request is a requet to perform with the client
 type Request struct {
 	// Exchange is the exchange to which the rquest will be published when
@@ -31,20 +36,97 @@ type Request struct {
 
 	// Context is a context which you can use to pass data from where the
 	// request is created to middlewares. By default this will be a
-	// context.Background()
+	// context.Background(). If the context is canceled or reaches its
+	// deadline the client will stop waiting for the request.
 	Context context.Context
 
 	// middlewares holds slice of middlewares to run before or after the client
 	// sends a request. This is only executed for the specific request.
 	middlewares []ClientMiddlewareFunc
 
+	// numRetries only seeds the numRetries of the pendingRequest created
+	// each time the request is sent, the retries are counted there. The
+	// publisher only retries a request which has not been retried, so a
+	// value above 0 makes it give up on the first failed publishing.
+	numRetries int
+
+	// multipleReplies tells the client to wait for more than one reply, the
+	// replies received will be stored in replies.
+	multipleReplies bool
+	expectedReplies int
+	replyStopFunc   ReplyStopFunc
+	replies         []*amqp.Delivery
+
+	// payload is encoded as the body when the request is sent, see
+	// WithPayload.
+	payload    interface{}
+	hasPayload bool
+
+	// stream is set when the request is sent with Client.Stream, all replies
+	// will be forwarded to it and sequence is the number of replies so far.
+	// streamClosed is closed when the reader stops reading the stream.
+	stream       chan *amqp.Delivery
+	streamClosed chan struct{}
+	sequence     int
+
+	// delay and deliverAt tells the client to let the broker hold the
+	// request before it's delivered, see WithDelay and WithDeliverAt.
+	delay     time.Duration
+	deliverAt time.Time
+}
+
+// pendingRequest is a request being sent by the client. A new one is created
+// each time a request is sent so that a request sent again, i.e. by the retry
+// middleware, never mixes up the attempts.
+type pendingRequest struct {
+	request *Request
+
+	// publishing is a copy of the publishing of the request, taken when it
+	// was sent, which is the one published.
+	publishing amqp.Publishing
+
 	// These channels are used by the repliesConsumer and correlcationIdMapping and will send the
-	// replies to this Request here.
+	// replies to this request here.
 	response chan *amqp.Delivery
 	errChan  chan error // If we get a client error (e.g we can't publish) it will end up here.
 
-	// the number of times that the publisher should retry.
+	// done is closed when the request is no longer waiting for replies.
+	done chan struct{}
+
+	// the number of times that the publisher has retried.
 	numRetries int
+
+	// delay is how long the broker should hold the request, computed once
+	// when the request is sent so the timeout and the destination agree.
+	delay time.Duration
+}
+
+// newPendingRequest returns a pendingRequest for r. The response and error
+// channels are buffered so that the publisher or the replies consumer never
+// blocks on a request that has already given up.
+func newPendingRequest(r *Request) *pendingRequest {
+	return &pendingRequest{
+		request:    r,
+		publishing: r.Publishing,
+		response:   make(chan *amqp.Delivery, 1),
+		errChan:    make(chan error, 1),
+		done:       make(chan struct{}),
+		numRetries: r.numRetries,
+		delay:      r.deliveryDelay(),
+	}
+}
+
+// snapshotPublishing will copy the publishing of the request, including the
+// headers, so the request can be changed while it's being published.
+func (p *pendingRequest) snapshotPublishing() {
+	p.publishing = p.request.Publishing
+
+	if p.request.Publishing.Headers != nil {
+		p.publishing.Headers = amqp.Table{}
+		for k, v := range p.request.Publishing.Headers {
+			p.publishing.Headers[k] = v
+		}
+	}
 }
 
 // NewRequest will generate a new request to be published. The default request
@@ -114,6 +196,37 @@ func (r *Request) WithTimeout(t time.Duration) *Request {
 	return r
 }
 
+// WithPriority will set the priority of the request. Requests with a higher
+// priority are published before requests with a lower priority waiting in the
+// client and, if the queue is declared with a max priority, delivered before
+// them by the broker. See HandlerBinding.WithMaxPriority.
+func (r *Request) WithPriority(p uint8) *Request {
+	r.Publishing.Priority = p
+
+	return r
+}
+
+// WithDelay will make the broker hold the request for d before it's delivered
+// to the exchange and routing key of the request. The timeout of the request
+// starts when it's delivered. See Client.WithDelayedMessageExchange for how
+// delayed requests are published.
+func (r *Request) WithDelay(d time.Duration) *Request {
+	r.delay = d
+	r.deliverAt = time.Time{}
+
+	return r
+}
+
+// WithDeliverAt will make the broker hold the request until t before it's
+// delivered to the exchange and routing key of the request, just like
+// WithDelay.
+func (r *Request) WithDeliverAt(t time.Time) *Request {
+	r.deliverAt = t
+	r.delay = 0
+
+	return r
+}
+
 // WithResponse sets the value determining wether the request should wait for a
 // response or not. A request that does not require a response will only catch
 // errors occurring before the reuqest has been published.
@@ -123,6 +236,27 @@ func (r *Request) WithResponse(wr bool) *Request {
 	return r
 }
 
+// WithMultipleReplies will make the request wait for more than one reply,
+// i.e. when sending to a fanout exchange. If expected is larger than zero the
+// request will be finished as soon as that many replies are received,
+// otherwise replies are gathered until the request times out. Use
+// Client.Gather to get all the replies.
+func (r *Request) WithMultipleReplies(expected int) *Request {
+	r.multipleReplies = true
+	r.expectedReplies = expected
+
+	return r
+}
+
+// WithReplyStopFunc will set a function used to decide when to stop gathering
+// replies for a request waiting for multiple replies.
+func (r *Request) WithReplyStopFunc(f ReplyStopFunc) *Request {
+	r.multipleReplies = true
+	r.replyStopFunc = f
+
+	return r
+}
+
 // WithContentType will update the content type passed in the header of the
 // request. This value will bee set as the ContentType in the amqp.Publishing
 // type but also preserved as a header value.
@@ -140,6 +274,36 @@ func (r *Request) WithBody(b string) *Request {
 	return r
 }
 
+// WithPayload will set a value to encode as the body when the request is
+// sent. The codec registered for the content type of the request is used and
+// if there is none, the payload is encoded as JSON and the content type set
+// accordingly. The payload is encoded before any middlewares are executed.
+func (r *Request) WithPayload(v interface{}) *Request {
+	r.payload = v
+	r.hasPayload = true
+
+	return r
+}
+
+// encodePayload will encode the payload, if any, as the body.
+func (r *Request) encodePayload() error {
+	if !r.hasPayload {
+		return nil
+	}
+
+	c := codecOrDefault(r.Publishing.ContentType)
+
+	body, err := c.Marshal(r.payload)
+	if err != nil {
+		return err
+	}
+
+	r.Publishing.ContentType = c.ContentType()
+	r.Publishing.Body = body
+
+	return nil
+}
+
 // Write will write the response Body of the amqp.Publishing.
 // It is safe to call Write multiple times.
 func (r *Request) Write(p []byte) (int, error) {
@@ -158,9 +322,48 @@ func (r *Request) AddMiddleware(m ClientMiddlewareFunc) *Request {
 
 // startTimeout will start the timeout counter by using Duration.After.
 // Is will also set the Expiration field for the Publishing so that amqp won't
-// hold on to the message in the queue after the timeout has happened.
-func (r *Request) startTimeout() <-chan time.Time {
-	r.Publishing.Expiration = fmt.Sprintf("%d", r.Timeout.Nanoseconds()/1e6)
+// hold on to the message in the queue after the timeout has happened and the
+// DeadlineHeader so the handler knows when we stop waiting. The timeout
+// starts after delay, the longest time the request might be delayed. Streaming requests
+// get no deadline since the timeout is the time between two replies and
+// requests without reply since no one is waiting.
+func (r *Request) startTimeout(delay time.Duration) <-chan time.Time {
+	timeout := r.Timeout
+
+	// We can't wait longer than the deadline of the context, i.e. when the
+	// request is sent from a handler with the context of the handler.
+	if remaining, ok := RemainingBudget(r.Context); ok && remaining-delay < timeout {
+		timeout = remaining - delay
+
+		if timeout < time.Millisecond {
+			timeout = time.Millisecond
+		}
+	}
+
+	timeout = timeout.Round(time.Millisecond)
+
+	r.Publishing.Expiration = fmt.Sprintf("%d", timeout.Nanoseconds()/1e6)
+	if r.stream == nil && r.Reply {
+		r.writeDeadline(time.Now().Add(delay + timeout))
+	}
+
+	// A delayed request can't time out before it's delivered. The timeout
+	// isn't shortened by the context since it's done by then anyway.
+	return time.After(r.Timeout + delay)
+}
+
+// deliveryDelay returns how long from now the broker should hold the
+// request, 0 if it should be delivered right away.
+func (r *Request) deliveryDelay() time.Duration {
+	delay := r.delay
+
+	if !r.deliverAt.IsZero() {
+		delay = time.Until(r.deliverAt)
+	}
+
+	if delay < time.Millisecond {
+		return 0
+	}
 
-	return time.After(r.Timeout)
+	return delay.Round(time.Millisecond)
 }
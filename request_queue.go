@@ -0,0 +1,154 @@
+package amqprpc
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// requestQueue holds the requests waiting to be published. Requests with a
+// higher priority are published first and requests with the same priority
+// are published in the order they were queued. Requests are removed when
+// their sender stops waiting so the queue never grows past the number of
+// requests being sent.
+type requestQueue struct {
+	mu       sync.Mutex
+	requests requestHeap
+
+	// queued maps the requests in the queue to their place in the heap.
+	queued map[*pendingRequest]*queuedRequest
+
+	// sequence is increased for each request queued to keep the order of
+	// requests with the same priority.
+	sequence uint64
+
+	// ready is signaled when requests are queued, it's buffered so pushing
+	// never blocks.
+	ready chan struct{}
+}
+
+type queuedRequest struct {
+	request  *pendingRequest
+	sequence uint64
+
+	// index is the index in the heap, maintained by the heap.Interface
+	// methods.
+	index int
+}
+
+func newRequestQueue() *requestQueue {
+	return &requestQueue{
+		queued: map[*pendingRequest]*queuedRequest{},
+		ready:  make(chan struct{}, 1),
+	}
+}
+
+// push will add r to the queue unless it's sender has stopped waiting for it,
+// it would never be removed then.
+func (q *requestQueue) push(r *pendingRequest) {
+	q.mu.Lock()
+
+	select {
+	case <-r.done:
+		q.mu.Unlock()
+		return
+	default:
+	}
+
+	q.sequence++
+
+	qr := &queuedRequest{request: r, sequence: q.sequence}
+	q.queued[r] = qr
+	heap.Push(&q.requests, qr)
+
+	q.mu.Unlock()
+
+	q.signal()
+}
+
+// remove will remove r from the queue if it's still queued. It's called when
+// the sender of r stops waiting for it, after r.done is closed.
+func (q *requestQueue) remove(r *pendingRequest) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	qr, ok := q.queued[r]
+	if !ok {
+		return
+	}
+
+	heap.Remove(&q.requests, qr.index)
+	delete(q.queued, r)
+}
+
+// pop will remove and return the request with the highest priority. If
+// there are more requests queued ready is signaled again.
+func (q *requestQueue) pop() (*pendingRequest, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.requests) == 0 {
+		return nil, false
+	}
+
+	r := heap.Pop(&q.requests).(*queuedRequest).request
+	delete(q.queued, r)
+
+	if len(q.requests) > 0 {
+		q.signal()
+	}
+
+	return r, true
+}
+
+// len returns the number of requests queued.
+func (q *requestQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.requests)
+}
+
+func (q *requestQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// requestHeap implements heap.Interface.
+type requestHeap []*queuedRequest
+
+func (h requestHeap) Len() int {
+	return len(h)
+}
+
+func (h requestHeap) Less(i, j int) bool {
+	pi, pj := h[i].request.publishing.Priority, h[j].request.publishing.Priority
+	if pi != pj {
+		return pi > pj
+	}
+
+	return h[i].sequence < h[j].sequence
+}
+
+func (h requestHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *requestHeap) Push(x interface{}) {
+	item := x.(*queuedRequest)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *requestHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+
+	return item
+}
@@ -0,0 +1,84 @@
+package amqprpc
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestQueue(t *testing.T) {
+	q := newRequestQueue()
+
+	_, ok := q.pop()
+	assert.False(t, ok, "empty queue")
+
+	q.push(newPendingRequest(NewRequest().WithCorrelationID("low-1")))
+	q.push(newPendingRequest(NewRequest().WithCorrelationID("high-1").WithPriority(5)))
+	q.push(newPendingRequest(NewRequest().WithCorrelationID("low-2")))
+	q.push(newPendingRequest(NewRequest().WithCorrelationID("high-2").WithPriority(5)))
+	q.push(newPendingRequest(NewRequest().WithCorrelationID("highest").WithPriority(9)))
+
+	assert.Equal(t, 5, q.len(), "all requests queued")
+
+	order := []string{}
+
+	for {
+		select {
+		case <-q.ready:
+		default:
+			assert.Equal(t, 0, q.len(), "ready is signaled while requests are queued")
+			assert.Equal(t, []string{"highest", "high-1", "high-2", "low-1", "low-2"}, order, "highest priority first, then in order")
+
+			return
+		}
+
+		r, ok := q.pop()
+		assert.True(t, ok, "request popped when ready")
+
+		order = append(order, r.publishing.CorrelationId)
+	}
+}
+
+func TestRequestQueueRemove(t *testing.T) {
+	q := newRequestQueue()
+
+	requests := []*pendingRequest{}
+	for i := 0; i < 5; i++ {
+		p := newPendingRequest(NewRequest().WithCorrelationID(fmt.Sprintf("request-%d", i)).WithPriority(uint8(i % 2)))
+		requests = append(requests, p)
+		q.push(p)
+	}
+
+	q.remove(requests[1])
+	q.remove(requests[2])
+	q.remove(requests[2])
+	assert.Equal(t, 3, q.len(), "removed requests not queued")
+
+	close(requests[1].done)
+	q.push(requests[1])
+	assert.Equal(t, 3, q.len(), "abandoned request not queued again")
+
+	order := []string{}
+	for {
+		r, ok := q.pop()
+		if !ok {
+			break
+		}
+
+		order = append(order, r.publishing.CorrelationId)
+	}
+
+	assert.Equal(t, []string{"request-3", "request-0", "request-4"}, order, "order kept after remove")
+}
+
+func TestMaxPriority(t *testing.T) {
+	binding := DirectBinding("myqueue", nil).WithMaxPriority(10)
+	assert.Equal(t, uint8(10), binding.MaxPriority, "max priority set")
+
+	args := maxPriorityQueueArgs(binding, nil)
+	assert.Equal(t, int32(10), args["x-max-priority"], "max priority argument added")
+
+	r := NewRequest().WithPriority(3)
+	assert.Equal(t, uint8(3), r.Publishing.Priority, "priority set on publishing")
+}
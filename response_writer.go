@@ -2,6 +2,17 @@ package amqprpc
 
 import "github.com/streadway/amqp"
 
+const (
+	// StreamSequenceHeader is the header holding the sequence number of each
+	// response when a handler streams it's response by calling Flush. The
+	// first response has sequence number 0.
+	StreamSequenceHeader = "X-Stream-Sequence"
+
+	// StreamEndHeader is set to true on the last response when a handler
+	// streams it's response by calling Flush.
+	StreamEndHeader = "X-Stream-End"
+)
+
 /*
 ResponseWriter is used by a handler to construct an RPC response.
 The ResponseWriter may NOT be used after the handler has returned.
@@ -16,6 +27,16 @@ type ResponseWriter struct {
 	publishing *amqp.Publishing
 	mandatory  bool
 	immediate  bool
+
+	// flush is used to publish a partial response, it's set by the server.
+	flush func(amqp.Publishing)
+
+	// sequence is the number of partial responses flushed so far.
+	sequence int64
+
+	// requestContentType is the content type of the request being handled,
+	// used to pick a codec when encoding the response.
+	requestContentType string
 }
 
 // NewResponseWriter will create a new response writer with given amqp.Publishing.
@@ -41,6 +62,30 @@ func (rw *ResponseWriter) WriteHeader(header string, value interface{}) {
 	rw.publishing.Headers[header] = value
 }
 
+// Encode will encode v as the body of the response, replacing anything
+// written so far. The codec registered for the content type of the response is
+// used. If the response has no content type, the content type of the request
+// is used if there's a codec registered for it, otherwise v is encoded as
+// JSON. The content type of the response is set to the one used.
+func (rw *ResponseWriter) Encode(v interface{}) error {
+	contentType := rw.publishing.ContentType
+	if contentType == "" {
+		contentType = rw.requestContentType
+	}
+
+	c := codecOrDefault(contentType)
+
+	body, err := c.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	rw.publishing.ContentType = c.ContentType()
+	rw.publishing.Body = body
+
+	return nil
+}
+
 // Publishing returns the internal amqp.Publishing that are used for the
 // response, useful for modification.
 func (rw *ResponseWriter) Publishing() *amqp.Publishing {
@@ -56,3 +101,49 @@ func (rw *ResponseWriter) Mandatory(m bool) {
 func (rw *ResponseWriter) Immediate(i bool) {
 	rw.immediate = i
 }
+
+/*
+Flush will publish everything written so far as a partial response to the
+client and reset the body. Each partial response will have the
+StreamSequenceHeader set and the response published when the handler returns
+will also have the StreamEndHeader set. Use Client.Stream to receive all the
+partial responses.
+
+	for _, page := range pages {
+		encoder.Encode(page)
+		rw.Flush()
+	}
+
+Flush does nothing if the ResponseWriter isn't created by a server, the body
+will then be kept as a part of the final response.
+*/
+func (rw *ResponseWriter) Flush() {
+	if rw.flush == nil {
+		return
+	}
+
+	publishing := *rw.publishing
+	publishing.Headers = amqp.Table{}
+
+	for k, v := range rw.publishing.Headers {
+		publishing.Headers[k] = v
+	}
+
+	publishing.Headers[StreamSequenceHeader] = rw.sequence
+
+	rw.flush(publishing)
+
+	rw.sequence++
+	rw.publishing.Body = []byte{}
+}
+
+// endStream will mark the response as the last one if the response has been
+// streamed by calling Flush.
+func (rw *ResponseWriter) endStream() {
+	if rw.sequence == 0 {
+		return
+	}
+
+	rw.WriteHeader(StreamSequenceHeader, rw.sequence)
+	rw.WriteHeader(StreamEndHeader, true)
+}
@@ -45,3 +45,43 @@ func TestResponseWriter(t *testing.T) {
 	rw.WriteHeader("some-header", 1)
 	assert.Equal(1, rw.Publishing().Headers["some-header"], "writing other types than s t rings to header works")
 }
+
+func TestResponseWriterFlush(t *testing.T) {
+	assert := assert.New(t)
+
+	rw := &ResponseWriter{
+		publishing: &amqp.Publishing{},
+	}
+
+	fmt.Fprint(rw, "Foo")
+	rw.Flush()
+	rw.endStream()
+
+	assert.Equal([]byte("Foo"), rw.Publishing().Body, "flush without server keeps the body")
+	assert.Nil(rw.Publishing().Headers, "no stream headers when not streaming")
+
+	flushed := []amqp.Publishing{}
+	rw.flush = func(p amqp.Publishing) {
+		flushed = append(flushed, p)
+	}
+
+	rw.WriteHeader("some-header", "writing")
+	rw.Flush()
+
+	fmt.Fprint(rw, "Bar")
+	rw.Flush()
+
+	fmt.Fprint(rw, "Baz")
+	rw.endStream()
+
+	assert.Equal(2, len(flushed), "all flushes published")
+	assert.Equal([]byte("Foo"), flushed[0].Body, "first partial response")
+	assert.Equal(int64(0), flushed[0].Headers[StreamSequenceHeader], "first sequence number")
+	assert.Equal("writing", flushed[0].Headers["some-header"], "headers kept in partial response")
+	assert.Equal([]byte("Bar"), flushed[1].Body, "body reset after flush")
+	assert.Equal(int64(1), flushed[1].Headers[StreamSequenceHeader], "second sequence number")
+
+	assert.Equal([]byte("Baz"), rw.Publishing().Body, "last response")
+	assert.Equal(int64(2), rw.Publishing().Headers[StreamSequenceHeader], "last sequence number")
+	assert.Equal(true, rw.Publishing().Headers[StreamEndHeader], "last response marks the end")
+}
@@ -25,6 +25,12 @@ type HandlerFunc func(context.Context, *ResponseWriter, amqp.Delivery)
 // OnStartedFunc is the function that can be passed to Server.OnStarted().
 type OnStartedFunc func(*amqp.Connection, *amqp.Connection, *amqp.Channel, *amqp.Channel)
 
+// OnStoppedFunc is the function that can be passed to Server.OnStopped().
+type OnStoppedFunc func()
+
+// OnErrorFunc is the function that can be passed to Server.OnError().
+type OnErrorFunc func(error)
+
 // processedRequest is used to add the response from a handler func combined
 // with a amqp.Delivery. The reasone we need to combine those is that we reply
 // to each request in a separate go routine and the delivery is required to
@@ -45,6 +51,13 @@ type Server struct {
 	// onStarteds will all be executed after the server has finished startup.
 	onStarteds []OnStartedFunc
 
+	// onStoppeds will all be executed when ListenAndServe is about to return.
+	onStoppeds []OnStoppedFunc
+
+	// onErrors will all be executed each time the server lost it's connection
+	// or failed to start.
+	onErrors []OnErrorFunc
+
 	// bindings is a list of HandlerBinding that holds information about the
 	// bindings and it's handlers.
 	bindings []HandlerBinding
@@ -63,6 +76,10 @@ type Server struct {
 	// include a dail function implemented in connection/dialer.go.
 	dialconfig amqp.Config
 
+	// connectionManager is used to get the connections from if set instead
+	// of creating new connections for the server.
+	connectionManager *ConnectionManager
+
 	// exchangeDelcareSettings is configurations used when declaring a RabbitMQ
 	// exchange.
 	exchangeDelcareSettings ExchangeDeclareSettings
@@ -76,12 +93,74 @@ type Server struct {
 	consumeSettings ConsumeSettings
 
 	// stopChan channel is used to signal shutdowns when calling Stop(). The
-	// channel will be closed when Stop() is called.
+	// channel will be closed when Stop() is called, stopOnce makes sure it's
+	// only closed once for each call to ListenAndServe().
 	stopChan chan struct{}
+	stopOnce *sync.Once
+
+	// stoppedChan is closed when ListenAndServe returns.
+	stoppedChan chan struct{}
+
+	// abortChan is closed by Shutdown() when it stops waiting for handlers
+	// to finish.
+	abortChan chan struct{}
+
+	// shutdownOnce makes Shutdown() only run once for each call to
+	// ListenAndServe(), later calls return shutdownErr.
+	shutdownOnce *sync.Once
+	shutdownErr  error
+
+	// baseContext is the context from which the context of each handler is
+	// derived, see WithBaseContext. handlerContext is derived from it each
+	// time the server is started and canceled with cancelHandlers by
+	// Shutdown().
+	baseContext    context.Context
+	handlerContext context.Context
+	cancelHandlers context.CancelFunc
 
 	// isRunning is 1 when the server is running.
 	isRunning int32
 
+	// isConnected is 1 when the server is connected and consuming.
+	isConnected int32
+
+	// inFlight is the number of handlers currently running.
+	inFlight int64
+
+	// mu is used to protect startedAt, boundQueues and reconnectAttempt for
+	// concurrent access from the health check. It also protects isRunning
+	// being set together with the fields set up for each call to
+	// ListenAndServe() and shutdownErr, which are read by Stop() and
+	// Shutdown().
+	mu sync.RWMutex
+
+	// startedAt is when ListenAndServe was called.
+	startedAt time.Time
+
+	// boundQueues holds the name of all queues consumed from.
+	boundQueues []string
+
+	// runningHandlers holds the handlers currently running, keyed by the
+	// sequence of each handler, so Shutdown() can tell which didn't finish.
+	runningHandlers map[uint64]UnfinishedHandler
+	handlerSequence uint64
+
+	// workerPools holds the worker pool for each binding, in the same order
+	// as boundQueues, see HandlerBinding.WithMaxConcurrency.
+	workerPools []*workerPool
+
+	// reconnectBackoff is used to decide how long to wait before each
+	// reconnect attempt.
+	reconnectBackoff BackoffStrategy
+
+	// maxReconnectAttempts is the number of reconnect attempts before the
+	// server gives up, 0 means that it will never give up.
+	maxReconnectAttempts int
+
+	// reconnectAttempt is the number of the current reconnect attempt, it's
+	// reset each time the server successfully starts.
+	reconnectAttempt int
+
 	// errorLog specifies an optional logger for amqp errors, unexpected behavior etc.
 	// If nil, logging is done via the log package's standard logger.
 	errorLog LogFunc
@@ -107,6 +186,8 @@ func NewServer(url string, qc QosConfig) *Server {
 		exchangeDelcareSettings: ExchangeDeclareSettings{Durable: true},
 		queueDeclareSettings:    QueueDeclareSettings{},
 		consumeSettings:         ConsumeSettings{},
+		reconnectBackoff:        ConstantBackoff(500 * time.Millisecond),
+		baseContext:             context.Background(),
 		errorLog:                log.Printf,                                  // use the standard logger default.
 		debugLog:                func(format string, args ...interface{}) {}, // don't print anything default.
 	}
@@ -121,6 +202,15 @@ func (s *Server) WithDialConfig(c amqp.Config) *Server {
 	return s
 }
 
+// WithConnectionManager makes the server use the connections of the
+// ConnectionManager instead of creating it's own connections. The server will
+// still create it's own channels. Any dial config set on the server is ignored.
+func (s *Server) WithConnectionManager(m *ConnectionManager) *Server {
+	s.connectionManager = m
+
+	return s
+}
+
 // WithErrorLogger sets the logger to use for error logging.
 func (s *Server) WithErrorLogger(f LogFunc) *Server {
 	s.errorLog = f
@@ -133,6 +223,17 @@ func (s *Server) WithDebugLogger(f LogFunc) *Server {
 	return s
 }
 
+// WithReconnectBackoff sets the BackoffStrategy used to decide how long to
+// wait before each reconnect attempt. If maxAttempts is larger than zero
+// ListenAndServe will give up and return after that many failed attempts in a
+// row.
+func (s *Server) WithReconnectBackoff(b BackoffStrategy, maxAttempts int) *Server {
+	s.reconnectBackoff = b
+	s.maxReconnectAttempts = maxAttempts
+
+	return s
+}
+
 // AddMiddleware will add a ServerMiddleware to the list of middlewares to be
 // triggered before the handle func for each request.
 func (s *Server) AddMiddleware(m ServerMiddlewareFunc) *Server {
@@ -154,6 +255,18 @@ func (s *Server) OnStarted(f OnStartedFunc) {
 	s.onStarteds = append(s.onStarteds, f)
 }
 
+// OnStopped will add a function which is executed when the server has
+// stopped, right before ListenAndServe returns.
+func (s *Server) OnStopped(f OnStoppedFunc) {
+	s.onStoppeds = append(s.onStoppeds, f)
+}
+
+// OnError will add a function which is executed with the error each time the
+// server lost it's connection or failed to start.
+func (s *Server) OnError(f OnErrorFunc) {
+	s.onErrors = append(s.onErrors, f)
+}
+
 // Bind will add a HandlerBinding to the list of servers to serve.
 func (s *Server) Bind(binding HandlerBinding) {
 	s.bindings = append(s.bindings, binding)
@@ -163,30 +276,68 @@ func (s *Server) Bind(binding HandlerBinding) {
 // consume from all RPC server queues and monitor to connection to ensure the
 // server is always connected.
 func (s *Server) ListenAndServe() {
-	s.responses = make(chan processedRequest)
-	s.stopChan = make(chan struct{}) // Ensure .Stop() can use it.
+	s.mu.Lock()
 
 	if !atomic.CompareAndSwapInt32(&s.isRunning, 0, 1) {
 		// Already running.
+		s.mu.Unlock()
 		panic("Server is already running.")
 	}
 
+	s.responses = make(chan processedRequest)
+	s.stopChan = make(chan struct{}) // Ensure .Stop() can use it.
+	s.stopOnce = &sync.Once{}
+	s.stoppedChan = make(chan struct{})
+	s.abortChan = make(chan struct{})
+	s.shutdownOnce = &sync.Once{}
+	s.shutdownErr = nil
+	s.handlerContext, s.cancelHandlers = context.WithCancel(s.baseContext)
+	s.startedAt = time.Now()
+	s.reconnectAttempt = 0
+
+	// The server might be started again as soon as isRunning is reset so
+	// keep what's used when we're done.
+	stoppedChan, cancelHandlers := s.stoppedChan, s.cancelHandlers
+
+	s.mu.Unlock()
+
 	for {
 		err := s.listenAndServe()
 
 		// If we couldn't run listenAndServe and an error was returned, make
 		// sure to check if the stopChan was closed - a user might know about
 		// connection problems and have call Stop(). If the channel isn't
-		// read/closed within 500ms, retry.
+		// read/closed within the backoff duration, retry.
 		if err != nil {
+			for _, onError := range s.onErrors {
+				onError(err)
+			}
+
+			if err == ErrConnectionManagerStopped {
+				s.errorLog("server: got error: %s, giving up", err)
+				break
+			}
+
+			s.mu.Lock()
+			s.reconnectAttempt++
+			s.mu.Unlock()
+
+			if s.maxReconnectAttempts > 0 && s.reconnectAttempt > s.maxReconnectAttempts {
+				s.errorLog("server: got error: %s, giving up after %d attempt(s)", err, s.maxReconnectAttempts)
+				break
+			}
+
+			backoff := s.reconnectBackoff(s.reconnectAttempt)
+
+			s.errorLog("server: got error: %s, will reconnect in %v (attempt %d)", err, backoff, s.reconnectAttempt)
+
 			select {
 			case _, ok := <-s.stopChan:
 				if !ok {
 					s.debugLog("server: the stopChan was triggered in a reconnect loop, exiting")
 					break
 				}
-			case <-time.After(500 * time.Millisecond):
-				s.errorLog("server: got error: %s, will reconnect in %v second(s)", err, 0.5)
+			case <-time.After(backoff):
 				continue
 			}
 		}
@@ -195,7 +346,14 @@ func (s *Server) ListenAndServe() {
 		break
 	}
 
+	for _, onStopped := range s.onStoppeds {
+		onStopped()
+	}
+
+	cancelHandlers()
+
 	atomic.StoreInt32(&s.isRunning, 0)
+	close(stoppedChan)
 }
 
 func (s *Server) listenAndServe() error {
@@ -206,12 +364,15 @@ func (s *Server) listenAndServe() error {
 	// Channel.Consume so not to have TCP pushback on publishing affect the
 	// ability to consume messages [...]"
 	// -- https://godoc.org/github.com/streadway/amqp#Channel.Consume
-	inputConn, outputConn, err := createConnections(s.url, s.dialconfig)
+	inputConn, outputConn, connErrs, cleanup, err := openConnections(s.url, s.dialconfig, s.connectionManager, s.stopChan)
+	if err == errStoppedWhileWaiting {
+		return nil
+	}
+
 	if err != nil {
 		return err
 	}
-	defer inputConn.Close()
-	defer outputConn.Close()
+	defer cleanup()
 
 	inputCh, outputCh, err := createChannels(inputConn, outputConn, s.qosConfig)
 
@@ -221,13 +382,25 @@ func (s *Server) listenAndServe() error {
 	defer inputCh.Close()
 	defer outputCh.Close()
 
+	// Dead lettered copies are published on the output connection too.
+	deadLetters, err := s.deadLetterPublisher(outputConn)
+	if err != nil {
+		return err
+	}
+
+	if deadLetters != nil {
+		defer deadLetters.ch.Close()
+
+		connErrs = append(connErrs, deadLetters.ch.NotifyClose(make(chan *amqp.Error)))
+	}
+
 	// Setup a WaitGroup for use by consume(). This WaitGroup will be 0
 	// when all consumers are finished consuming messages.
 	consumersWg := sync.WaitGroup{}
 	consumersWg.Add(1) // Sync the waitgroup to this goroutine.
 
 	// consumerTags is used when we later want to tell AMQP that we want to cancel our consumers.
-	consumerTags, err := s.startConsumers(inputCh, &consumersWg)
+	consumerTags, err := s.startConsumers(inputCh, deadLetters, &consumersWg)
 	if err != nil {
 		return err
 	}
@@ -238,6 +411,14 @@ func (s *Server) listenAndServe() error {
 
 	go s.responder(outputCh, &responderWg)
 
+	// We're started, start counting reconnect attempts from the beginning the
+	// next time we lose the connection.
+	s.mu.Lock()
+	s.reconnectAttempt = 0
+	s.mu.Unlock()
+
+	atomic.StoreInt32(&s.isConnected, 1)
+
 	// Notify everyone that the server has started. Runs sequentially so there
 	// isn't any race conditions when working with the connections or channels.
 	for _, onStarted := range s.onStarteds {
@@ -246,11 +427,15 @@ func (s *Server) listenAndServe() error {
 
 	err = monitorAndWait(
 		s.stopChan,
-		inputConn.NotifyClose(make(chan *amqp.Error)),
-		outputConn.NotifyClose(make(chan *amqp.Error)),
-		inputCh.NotifyClose(make(chan *amqp.Error)),
-		outputCh.NotifyClose(make(chan *amqp.Error)),
+		append(
+			connErrs,
+			inputCh.NotifyClose(make(chan *amqp.Error)),
+			outputCh.NotifyClose(make(chan *amqp.Error)),
+		)...,
 	)
+
+	atomic.StoreInt32(&s.isConnected, 0)
+
 	if err != nil {
 		return err
 	}
@@ -266,9 +451,14 @@ func (s *Server) listenAndServe() error {
 	}
 
 	// 2. We've told amqp to stop delivering messages, now we wait for all
-	// the consumers to finish inflight messages.
+	// the consumers to finish inflight messages. If Shutdown() stops waiting
+	// for them we leave the responses unpublished.
 	consumersWg.Done()
-	consumersWg.Wait()
+
+	if !s.waitForHandlers(&consumersWg) {
+		s.errorLog("server: stopped waiting for unfinished handlers")
+		return nil
+	}
 
 	// 3. Close the responses chan and wait until the consumers are finished.
 	// We might still have responses we want to send.
@@ -282,10 +472,15 @@ func (s *Server) listenAndServe() error {
 	return nil
 }
 
-func (s *Server) startConsumers(inputCh *amqp.Channel, wg *sync.WaitGroup) ([]string, error) {
+func (s *Server) startConsumers(inputCh *amqp.Channel, deadLetters *confirmedPublisher, wg *sync.WaitGroup) ([]string, error) {
+	s.mu.Lock()
+	s.boundQueues = []string{}
+	s.workerPools = []*workerPool{}
+	s.mu.Unlock()
+
 	consumerTags := []string{}
 	for _, binding := range s.bindings {
-		consumerTag, err := s.consume(binding, inputCh, wg)
+		consumerTag, err := s.consume(binding, inputCh, deadLetters, wg)
 		if err != nil {
 			return []string{}, err
 		}
@@ -296,7 +491,7 @@ func (s *Server) startConsumers(inputCh *amqp.Channel, wg *sync.WaitGroup) ([]st
 	return consumerTags, nil
 }
 
-func (s *Server) consume(binding HandlerBinding, inputCh *amqp.Channel, wg *sync.WaitGroup) (string, error) {
+func (s *Server) consume(binding HandlerBinding, inputCh *amqp.Channel, deadLetters *confirmedPublisher, wg *sync.WaitGroup) (string, error) {
 	queueName, err := s.declareAndBind(inputCh, binding)
 	if err != nil {
 		return "", err
@@ -317,21 +512,47 @@ func (s *Server) consume(binding HandlerBinding, inputCh *amqp.Channel, wg *sync
 		return "", err
 	}
 
+	// Each binding gets a new pool when we reconnect, handlers still running
+	// on the old channel can't ack their deliveries anyway.
+	pool := newWorkerPool(binding.MaxConcurrency)
+
+	s.mu.Lock()
+	s.boundQueues = append(s.boundQueues, queueName)
+	s.workerPools = append(s.workerPools, pool)
+	s.mu.Unlock()
+
 	// Attach the middlewares to the handler.
 	handler := ServerMiddlewareChain(binding.Handler, s.middlewares...)
 
-	go s.runHandler(handler, deliveries, queueName, wg)
+	go s.runHandler(handler, binding, pool, deadLetters, deliveries, queueName, wg)
 
 	return consumerTag, nil
 }
 
-func (s *Server) runHandler(handler HandlerFunc, deliveries <-chan amqp.Delivery, queueName string, wg *sync.WaitGroup) {
+func (s *Server) runHandler(handler HandlerFunc, binding HandlerBinding, pool *workerPool, deadLetters *confirmedPublisher, deliveries <-chan amqp.Delivery, queueName string, wg *sync.WaitGroup) {
 	wg.Add(1)
 	defer wg.Done()
 
 	s.debugLog("server: waiting for messages on queue '%s'", queueName)
 
 	for delivery := range deliveries {
+		received := time.Now()
+
+		// Wait for a handler to finish before starting a new one. No more
+		// deliveries are read meanwhile so the broker will hold on to them
+		// when the prefetch count is reached.
+		if err := pool.acquire(s.handlerContext); err != nil {
+			s.debugLog("server: requeuing delivery on queue %v correlation id %v: %s", queueName, delivery.CorrelationId, err.Error())
+
+			if err := delivery.Nack(false, true); err != nil {
+				s.errorLog("could not nack message: %s", err.Error())
+			}
+
+			continue
+		}
+
+		pool.start(time.Since(received))
+
 		// Add one delta to the wait group each time a delivery is handled so
 		// we can end by marking it as done. This will ensure that we don't
 		// close the responses channel until the very last go routin handling a
@@ -345,9 +566,34 @@ func (s *Server) runHandler(handler HandlerFunc, deliveries <-chan amqp.Delivery
 				CorrelationId: delivery.CorrelationId,
 				Body:          []byte{},
 			},
+			requestContentType: delivery.ContentType,
 		}
 
-		ctx := context.WithValue(context.Background(), CtxQueueName, queueName)
+		ctx := context.WithValue(s.handlerContext, CtxQueueName, queueName)
+
+		// The context is canceled when the client stops waiting for the
+		// reply so the handler can stop working on it.
+		ctx, cancel := deadlineContext(ctx, delivery)
+
+		// Deliveries nacked or rejected without requeue are dead lettered with
+		// the reason they failed. The copy is published on a channel of it's
+		// own in confirm mode so the delivery isn't acked until the broker has
+		// the copy.
+		if binding.DeadLetterExchange != "" {
+			original := delivery
+
+			delivery.Acknowledger = &deadLetterAcknowledger{
+				ch:       delivery.Acknowledger,
+				delivery: &original,
+				exchange: binding.DeadLetterExchange,
+				queue:    queueName,
+				reason: func() string {
+					return failureReason(&rw)
+				},
+				publish:  deadLetters.publish,
+				errorLog: s.errorLog,
+			}
+		}
 
 		// Use the default provided Acknowledger for the delivery
 		// (amqp.Channel) and add our ack aware acknowledger which can tell if
@@ -360,7 +606,26 @@ func (s *Server) runHandler(handler HandlerFunc, deliveries <-chan amqp.Delivery
 		delivery.Acknowledger = &aac
 
 		go func(delivery amqp.Delivery) {
+			// Partial responses flushed by the handler are published in
+			// order just like the final response.
+			rw.flush = func(publishing amqp.Publishing) {
+				s.respond(processedRequest{
+					replyTo:    delivery.ReplyTo,
+					mandatory:  rw.mandatory,
+					immediate:  rw.immediate,
+					publishing: publishing,
+				})
+			}
+
+			id := s.handlerStarted(queueName, delivery.CorrelationId)
+
+			atomic.AddInt64(&s.inFlight, 1)
 			handler(ctx, &rw, delivery)
+			atomic.AddInt64(&s.inFlight, -1)
+
+			s.handlerFinished(id)
+
+			cancel()
 
 			if !aac.IsHandled() {
 				if err := delivery.Ack(false); err != nil {
@@ -368,12 +633,16 @@ func (s *Server) runHandler(handler HandlerFunc, deliveries <-chan amqp.Delivery
 				}
 			}
 
-			s.responses <- processedRequest{
+			pool.release()
+
+			rw.endStream()
+
+			s.respond(processedRequest{
 				replyTo:    delivery.ReplyTo,
 				mandatory:  rw.mandatory,
 				immediate:  rw.immediate,
 				publishing: *rw.publishing,
-			}
+			})
 
 			// Mark the specific delivery as finished.
 			wg.Done()
@@ -384,13 +653,27 @@ func (s *Server) runHandler(handler HandlerFunc, deliveries <-chan amqp.Delivery
 }
 
 func (s *Server) declareAndBind(inputCh *amqp.Channel, binding HandlerBinding) (string, error) {
+	queueArgs := s.queueDeclareSettings.Args
+
+	if binding.DeadLetterExchange != "" {
+		if err := s.declareDeadLetter(inputCh, binding); err != nil {
+			return "", err
+		}
+
+		queueArgs = deadLetterQueueArgs(binding, queueArgs)
+	}
+
+	if binding.MaxPriority > 0 {
+		queueArgs = maxPriorityQueueArgs(binding, queueArgs)
+	}
+
 	queue, err := inputCh.QueueDeclare(
 		binding.QueueName,
 		s.queueDeclareSettings.Durable,
 		s.queueDeclareSettings.DeleteWhenUnused,
 		s.queueDeclareSettings.Exclusive,
 		s.queueDeclareSettings.NoWait,
-		s.queueDeclareSettings.Args,
+		queueArgs,
 	)
 
 	if err != nil {
@@ -434,7 +717,20 @@ func (s *Server) responder(outCh *amqp.Channel, wg *sync.WaitGroup) {
 	wg.Add(1)
 	defer wg.Done()
 
-	for response := range s.responses {
+	for {
+		var response processedRequest
+
+		select {
+		case r, ok := <-s.responses:
+			if !ok {
+				return
+			}
+
+			response = r
+		case <-s.abortChan:
+			return
+		}
+
 		s.debugLog(
 			"server: publishing response to %s, correlation id: %s",
 			response.replyTo, response.publishing.CorrelationId,
@@ -458,7 +754,7 @@ func (s *Server) responder(outCh *amqp.Channel, wg *sync.WaitGroup) {
 				"server: retrying publishing response to %s, correlation id: %s, reason: %s",
 				response.replyTo, response.publishing.CorrelationId, err.Error(),
 			)
-			s.responses <- response
+			s.respond(response)
 			return
 		}
 	}
@@ -466,10 +762,19 @@ func (s *Server) responder(outCh *amqp.Channel, wg *sync.WaitGroup) {
 
 // Stop will gracefully disconnect from AMQP after draining first incoming then
 // outgoing messages. This method won't wait for server shutdown to complete,
-// you should instead wait for ListenAndServe to exit.
+// you should instead wait for ListenAndServe to exit. It's safe to call Stop
+// more than once.
 func (s *Server) Stop() {
-	if atomic.LoadInt32(&s.isRunning) == 0 {
+	s.mu.RLock()
+	running := atomic.LoadInt32(&s.isRunning) == 1
+	stopOnce, stopChan := s.stopOnce, s.stopChan
+	s.mu.RUnlock()
+
+	if !running {
 		return
 	}
-	close(s.stopChan)
+
+	stopOnce.Do(func() {
+		close(stopChan)
+	})
 }
@@ -0,0 +1,171 @@
+package amqprpc
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WithBaseContext sets the context from which the context passed to each
+// handler is derived. When the context is canceled so are all handlers.
+func (s *Server) WithBaseContext(ctx context.Context) *Server {
+	s.baseContext = ctx
+
+	return s
+}
+
+/*
+Shutdown will gracefully stop the server. The consumers are canceled so no
+more deliveries are received and the context of all handlers still running is
+canceled. Shutdown then waits for the handlers to finish and for their
+responses to be published.
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("could not shut down gracefully: %s", err)
+	}
+
+If ctx is done before all handlers are finished an *ErrHandlersUnfinished
+listing the handlers still running is returned. The server will then stop
+waiting for them, their responses are dropped and the deliveries, which are
+never acknowledged, are redelivered by the broker. ListenAndServe will return
+once the connections are closed.
+
+Calling Shutdown again, i.e. from another go routine, will wait for the first
+call to finish and return the same result. It's safe to call Shutdown after
+Stop.
+*/
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.RLock()
+	running := atomic.LoadInt32(&s.isRunning) == 1
+	shutdownOnce := s.shutdownOnce
+	s.mu.RUnlock()
+
+	if !running && shutdownOnce == nil {
+		return nil
+	}
+
+	shutdownOnce.Do(func() {
+		err := s.shutdown(ctx)
+
+		s.mu.Lock()
+		s.shutdownErr = err
+		s.mu.Unlock()
+	})
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.shutdownErr
+}
+
+// shutdown does the work of Shutdown, it's only called once for each call to
+// ListenAndServe.
+func (s *Server) shutdown(ctx context.Context) error {
+	s.mu.RLock()
+	running := atomic.LoadInt32(&s.isRunning) == 1
+	stoppedChan, abortChan, cancelHandlers := s.stoppedChan, s.abortChan, s.cancelHandlers
+	s.mu.RUnlock()
+
+	if !running {
+		return nil
+	}
+
+	s.Stop()
+	cancelHandlers()
+
+	select {
+	case <-stoppedChan:
+		return nil
+	case <-ctx.Done():
+	}
+
+	unfinished := s.unfinishedHandlers()
+
+	close(abortChan)
+
+	if len(unfinished) == 0 {
+		return ctx.Err()
+	}
+
+	return &ErrHandlersUnfinished{
+		Handlers: unfinished,
+		Err:      ctx.Err(),
+	}
+}
+
+// handlerStarted will add the handler to the running handlers and return the
+// id to pass to handlerFinished.
+func (s *Server) handlerStarted(queueName, correlationID string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.runningHandlers == nil {
+		s.runningHandlers = map[uint64]UnfinishedHandler{}
+	}
+
+	s.handlerSequence++
+	s.runningHandlers[s.handlerSequence] = UnfinishedHandler{
+		QueueName:     queueName,
+		CorrelationID: correlationID,
+		StartedAt:     time.Now(),
+	}
+
+	return s.handlerSequence
+}
+
+// handlerFinished will remove the handler from the running handlers.
+func (s *Server) handlerFinished(id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.runningHandlers, id)
+}
+
+// unfinishedHandlers returns the handlers currently running, the one running
+// the longest first.
+func (s *Server) unfinishedHandlers() []UnfinishedHandler {
+	s.mu.RLock()
+	unfinished := make([]UnfinishedHandler, 0, len(s.runningHandlers))
+	for _, h := range s.runningHandlers {
+		unfinished = append(unfinished, h)
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(unfinished, func(i, j int) bool {
+		return unfinished[i].StartedAt.Before(unfinished[j].StartedAt)
+	})
+
+	return unfinished
+}
+
+// waitForHandlers will block until wg is done or until Shutdown has stopped
+// waiting for the handlers, in which case false is returned.
+func (s *Server) waitForHandlers(wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-s.abortChan:
+		return false
+	}
+}
+
+// respond will pass the response to the responder unless Shutdown has
+// stopped waiting for the handlers, in which case it's dropped.
+func (s *Server) respond(response processedRequest) {
+	select {
+	case s.responses <- response:
+	case <-s.abortChan:
+	}
+}
@@ -0,0 +1,71 @@
+package amqprpc
+
+import (
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// Stream represents a request sent with Client.Stream where the handler
+// streams it's response by calling ResponseWriter.Flush.
+type Stream struct {
+	// Request is the request that was sent.
+	Request *Request
+
+	// Replies will receive each partial reply, including the last one, in the
+	// order they were received. The channel is closed when the stream has
+	// ended or failed.
+	Replies chan *amqp.Delivery
+
+	// Error is the error that ended the stream, if any. It's safe to read
+	// after Replies has been closed.
+	Error error
+
+	closeOnce sync.Once
+}
+
+/*
+Stream will send the Request and forward each reply to the returned Stream
+until the reply marking the end of the stream is received. The request timeout
+is used as the longest time to wait between two replies.
+
+	stream := c.Stream(NewRequest().WithRoutingKey("export"))
+
+	for reply := range stream.Replies {
+		// Handle each page.
+	}
+
+	if stream.Error != nil {
+		// The stream did not finish.
+	}
+
+A handler not calling Flush will produce a stream with one single reply. If
+the replies are not read until Replies is closed the stream must be closed
+with Close.
+*/
+func (c *Client) Stream(r *Request) *Stream {
+	r.Reply = true
+	r.stream = make(chan *amqp.Delivery)
+	r.streamClosed = make(chan struct{})
+
+	s := &Stream{
+		Request: r,
+		Replies: r.stream,
+	}
+
+	go func() {
+		_, s.Error = c.Send(r)
+		close(s.Replies)
+	}()
+
+	return s
+}
+
+// Close will stop forwarding replies to the stream. Replies is closed and the
+// Error set to ErrStreamClosed unless the stream has already ended. It's safe
+// to call Close multiple times.
+func (s *Stream) Close() {
+	s.closeOnce.Do(func() {
+		close(s.Request.streamClosed)
+	})
+}
@@ -0,0 +1,91 @@
+package amqprpc
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientStream(t *testing.T) {
+	s := NewServer(serverTestURL, QosConfig{})
+	s.Bind(DirectBinding("stream", func(ctx context.Context, rw *ResponseWriter, d amqp.Delivery) {
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(rw, "page %d", i)
+			rw.Flush()
+		}
+
+		fmt.Fprint(rw, "done")
+	}))
+
+	s.Bind(DirectBinding("no-stream", func(ctx context.Context, rw *ResponseWriter, d amqp.Delivery) {
+		fmt.Fprint(rw, "single")
+	}))
+
+	stop := startAndWait(s)
+	defer stop()
+
+	c := NewClient(serverTestURL, QosConfig{})
+
+	stream := c.Stream(NewRequest().WithRoutingKey("stream"))
+
+	bodies := []string{}
+	for reply := range stream.Replies {
+		bodies = append(bodies, string(reply.Body))
+	}
+
+	assert.Nil(t, stream.Error, "no error from stream")
+	assert.Equal(t, []string{"page 0", "page 1", "page 2", "done"}, bodies, "all replies in order")
+
+	stream = c.Stream(NewRequest().WithRoutingKey("no-stream"))
+
+	bodies = []string{}
+	for reply := range stream.Replies {
+		bodies = append(bodies, string(reply.Body))
+	}
+
+	assert.Nil(t, stream.Error, "no error from stream")
+	assert.Equal(t, []string{"single"}, bodies, "single reply when handler doesn't flush")
+}
+
+func TestIsStreamEnd(t *testing.T) {
+	assert.True(t, isStreamEnd(&amqp.Delivery{}), "reply without sequence ends stream")
+	assert.False(t, isStreamEnd(&amqp.Delivery{
+		Headers: amqp.Table{StreamSequenceHeader: int64(0)},
+	}), "partial reply doesn't end stream")
+	assert.True(t, isStreamEnd(&amqp.Delivery{
+		Headers: amqp.Table{StreamSequenceHeader: int64(1), StreamEndHeader: true},
+	}), "end header ends stream")
+}
+
+func TestStreamClose(t *testing.T) {
+	r := NewRequest()
+	r.stream = make(chan *amqp.Delivery)
+	r.streamClosed = make(chan struct{})
+
+	p := newPendingRequest(r)
+	p.response <- &amqp.Delivery{Body: []byte("single")}
+
+	s := &Stream{Request: r, Replies: r.stream}
+
+	c := NewClient("", QosConfig{})
+
+	done := make(chan error)
+	go func() {
+		_, err := c.waitForStream(p, nil)
+		done <- err
+	}()
+
+	s.Close()
+	s.Close()
+
+	select {
+	case err := <-done:
+		assert.Equal(t, ErrStreamClosed, err, "stream closed while the reply isn't read")
+	case <-time.After(time.Second):
+		t.Error("stream not closed")
+	}
+}
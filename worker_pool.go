@@ -0,0 +1,142 @@
+package amqprpc
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// WorkerStats holds metrics for the handlers of a queue consumed by the
+// server.
+type WorkerStats struct {
+	// MaxConcurrency is the maximum number of handlers running at the same
+	// time, 0 means no limit. See HandlerBinding.WithMaxConcurrency.
+	MaxConcurrency int `json:"max_concurrency"`
+
+	// Active is the number of handlers currently running.
+	Active int `json:"active"`
+
+	// Waiting is the number of deliveries received waiting for a handler to
+	// finish before they can be handled. Deliveries are read one at a time so
+	// it's never more than one, the rest are held by the broker.
+	Waiting int `json:"waiting"`
+
+	// Handled is the number of deliveries handled.
+	Handled uint64 `json:"handled"`
+
+	// TotalQueueTime is the sum of the time each delivery has waited from
+	// being received by the server until it was handled.
+	TotalQueueTime time.Duration `json:"total_queue_time"`
+
+	// MaxQueueTime is the longest time a delivery has waited from being
+	// received by the server until it was handled.
+	MaxQueueTime time.Duration `json:"max_queue_time"`
+}
+
+// workerPool limits the number of handlers running at the same time for a
+// queue and keeps the WorkerStats for it.
+type workerPool struct {
+	// workers holds one value for each handler running, it's nil if there is
+	// no limit.
+	workers chan struct{}
+
+	mu    sync.Mutex
+	stats WorkerStats
+}
+
+func newWorkerPool(maxConcurrency int) *workerPool {
+	p := &workerPool{
+		stats: WorkerStats{
+			MaxConcurrency: maxConcurrency,
+		},
+	}
+
+	if maxConcurrency > 0 {
+		p.workers = make(chan struct{}, maxConcurrency)
+	}
+
+	return p
+}
+
+// acquire will block until a handler can be started or until ctx is done.
+// Deliveries waiting are counted in the stats.
+func (p *workerPool) acquire(ctx context.Context) error {
+	if p.workers == nil {
+		return nil
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.stats.Waiting++
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		p.stats.Waiting--
+		p.mu.Unlock()
+	}()
+
+	select {
+	case p.workers <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// start will record that a handler started after the delivery waited for
+// queueTime.
+func (p *workerPool) start(queueTime time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.stats.Active++
+	p.stats.TotalQueueTime += queueTime
+
+	if queueTime > p.stats.MaxQueueTime {
+		p.stats.MaxQueueTime = queueTime
+	}
+}
+
+// release will record that a handler finished and let the next one start.
+func (p *workerPool) release() {
+	p.mu.Lock()
+	p.stats.Active--
+	p.stats.Handled++
+	p.mu.Unlock()
+
+	if p.workers != nil {
+		<-p.workers
+	}
+}
+
+// Stats returns a copy of the current stats.
+func (p *workerPool) Stats() WorkerStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.stats
+}
+
+// WorkerStats returns the WorkerStats for each queue the server is consuming
+// from.
+func (s *Server) WorkerStats() map[string]WorkerStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.workerStats()
+}
+
+// workerStats returns the WorkerStats for each queue, s.mu must be held.
+func (s *Server) workerStats() map[string]WorkerStats {
+	stats := map[string]WorkerStats{}
+
+	for i, queueName := range s.boundQueues {
+		stats[queueName] = s.workerPools[i].Stats()
+	}
+
+	return stats
+}
@@ -0,0 +1,118 @@
+package amqprpc
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerPool(t *testing.T) {
+	pool := newWorkerPool(1)
+
+	assert.Nil(t, pool.acquire(context.Background()), "no error")
+	pool.start(10 * time.Millisecond)
+
+	acquired := make(chan struct{})
+
+	go func() {
+		assert.Nil(t, pool.acquire(context.Background()), "no error")
+		close(acquired)
+	}()
+
+	for pool.Stats().Waiting == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	stats := pool.Stats()
+	assert.Equal(t, 1, stats.MaxConcurrency, "max concurrency is set")
+	assert.Equal(t, 1, stats.Active, "one handler running")
+	assert.Equal(t, 1, stats.Waiting, "second delivery is waiting")
+
+	pool.release()
+	<-acquired
+
+	pool.start(30 * time.Millisecond)
+	pool.release()
+
+	stats = pool.Stats()
+	assert.Equal(t, 0, stats.Active, "no handlers running")
+	assert.Equal(t, 0, stats.Waiting, "no deliveries waiting")
+	assert.Equal(t, uint64(2), stats.Handled, "both deliveries handled")
+	assert.Equal(t, 40*time.Millisecond, stats.TotalQueueTime, "queue time summed")
+	assert.Equal(t, 30*time.Millisecond, stats.MaxQueueTime, "longest queue time kept")
+
+	assert.Nil(t, pool.acquire(context.Background()), "no error")
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		for pool.Stats().Waiting == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		cancel()
+	}()
+
+	assert.Equal(t, context.Canceled, pool.acquire(ctx), "stops waiting when context is done")
+	assert.Equal(t, 0, pool.Stats().Waiting, "no deliveries waiting")
+	assert.Equal(t, context.Canceled, pool.acquire(ctx), "no handler started when context is done")
+
+	pool.release()
+
+	binding := DirectBinding("myqueue", nil).WithMaxConcurrency(3)
+	assert.Equal(t, 3, binding.MaxConcurrency, "max concurrency set on binding")
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	var (
+		running    int32
+		maxRunning int32
+		wg         sync.WaitGroup
+	)
+
+	s := NewServer(serverTestURL, QosConfig{})
+	s.Bind(DirectBinding("max-concurrency", func(ctx context.Context, rw *ResponseWriter, d amqp.Delivery) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+
+		for {
+			current := atomic.LoadInt32(&maxRunning)
+			if n <= current || atomic.CompareAndSwapInt32(&maxRunning, current, n) {
+				break
+			}
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}).WithMaxConcurrency(2))
+
+	stop := startAndWait(s)
+	defer stop()
+
+	client := NewClient(serverTestURL, QosConfig{})
+	defer client.Stop()
+
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			_, err := client.Send(NewRequest().WithRoutingKey("max-concurrency"))
+			assert.Nil(t, err, "no error from request")
+		}()
+	}
+
+	wg.Wait()
+
+	stats := s.WorkerStats()["max-concurrency"]
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&maxRunning), "never more than two handlers running")
+	assert.Equal(t, 2, stats.MaxConcurrency, "max concurrency in stats")
+	assert.Equal(t, uint64(6), stats.Handled, "all deliveries handled")
+	assert.True(t, stats.MaxQueueTime >= 50*time.Millisecond, "deliveries waited for a handler")
+}